@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrAuditTampered = errors.New("audit log tampered")
+
+const (
+	AuditSucceeded = "succeeded"
+	AuditFailed    = "failed"
+)
+
+// AuditEntry 是审计日志中的一行。Hash 是去掉 Hash 字段后整行 JSON 的 SHA-256，
+// 而 PrevHash 指向上一行的 Hash，因此修改、删除或插入任何一行都会破坏链。
+type AuditEntry struct {
+	Seq      int64         `json:"seq"`
+	Time     time.Time     `json:"time"`
+	UserId   string        `json:"userId"`
+	FileId   string        `json:"fileId"`
+	Step     string        `json:"step"`
+	Outcome  string        `json:"outcome"`
+	Kind     string        `json:"kind,omitempty"`
+	Duration time.Duration `json:"duration"`
+	PrevHash string        `json:"prevHash"`
+	Hash     string        `json:"hash,omitempty"`
+}
+
+// AuditHead 是链上最后一条记录的位置，保存在日志之外即可发现尾部被截断。
+// AuditLog 把它写在日志旁边的 <path>.head 文件中。
+type AuditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+func (e *AuditEntry) digest() (string, error) {
+	unsigned := *e
+	unsigned.Hash = ""
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type AuditOption func(*AuditLog)
+
+// AuditLog 以只追加的方式把上传结果写成 JSON Lines，每条记录都链接到上一条
+type AuditLog struct {
+	clock    Clock
+	headPath string
+
+	mu   sync.Mutex
+	f    *os.File
+	head AuditHead
+	size int64 // 最后一条完整记录之后的偏移
+}
+
+// OpenAuditLog 打开或创建审计日志。已有内容会先完整校验，链断开、
+// 日志不包含 <path>.head 记录的位置（尾部被截断或整个日志被删除）、
+// 或日志有内容却缺少 <path>.head 时拒绝继续追加。
+func OpenAuditLog(path string, opts ...AuditOption) (*AuditLog, error) {
+	want, err := readAuditHead(path + ".head")
+	if err != nil {
+		return nil, fmt.Errorf("open audit log %s: %w", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*AuditLog, error) {
+		f.Close()
+		return nil, fmt.Errorf("open audit log %s: %w", path, err)
+	}
+
+	// 追加后、更新 .head 前崩溃时日志会比 .head 多出几条，只要链经过 .head 记录的位置就接受
+	reached := want == (AuditHead{})
+	head, err := walkAuditLog(f, func(h AuditHead) {
+		reached = reached || h == want
+	})
+	switch {
+	case err != nil:
+		return fail(err)
+	case !reached:
+		return fail(fmt.Errorf("%w: log ends at seq %d, expected seq %d", ErrAuditTampered, head.Seq, want.Seq))
+	case want == (AuditHead{}) && head.Seq > 0:
+		return fail(fmt.Errorf("%w: missing head file for %d entries", ErrAuditTampered, head.Seq))
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+
+	a := &AuditLog{clock: realClock{}, headPath: path + ".head", f: f, head: head, size: info.Size()}
+	if head != want {
+		if err := a.writeHead(head); err != nil {
+			return fail(err)
+		}
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a, nil
+}
+
+// readAuditHead 读取日志之外保存的位置，文件不存在时返回零值
+func readAuditHead(path string) (AuditHead, error) {
+	var head AuditHead
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return head, nil
+	}
+	if err != nil {
+		return head, err
+	}
+	if err := json.Unmarshal(data, &head); err != nil || head.Seq <= 0 {
+		return head, fmt.Errorf("%w: malformed head file", ErrAuditTampered)
+	}
+	return head, nil
+}
+
+func (a *AuditLog) writeHead(head AuditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.headPath, data)
+}
+
+func WithAuditClock(clock Clock) AuditOption {
+	return func(a *AuditLog) {
+		a.clock = clock
+	}
+}
+
+// WithAudit 记录每次上传到达的步骤、结果与耗时
+func WithAudit(log *AuditLog) Option {
+	return func(upload *UploadFileService) {
+		upload.audit = log
+	}
+}
+
+// Head 返回最后一条记录的位置
+func (a *AuditLog) Head() AuditHead {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.head
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// Append 补全序号、时间与哈希后写入一条记录，并在返回前刷到磁盘、更新 .head。
+// 任何一步失败都把日志截回上一条完整记录之后，不留下写了一半的行。
+func (a *AuditLog) Append(e AuditEntry) (AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e.Seq = a.head.Seq + 1
+	e.Time = a.clock.Now().UTC()
+	e.PrevHash = a.head.Hash
+	hash, err := e.digest()
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	e.Hash = hash
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	line = append(line, '\n')
+	head := AuditHead{Seq: e.Seq, Hash: e.Hash}
+	if err := a.write(line, head); err != nil {
+		return AuditEntry{}, errors.Join(err, a.f.Truncate(a.size))
+	}
+	a.head = head
+	a.size += int64(len(line))
+	return e, nil
+}
+
+func (a *AuditLog) write(line []byte, head AuditHead) error {
+	if _, err := a.f.Write(line); err != nil {
+		return err
+	}
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	return a.writeHead(head)
+}
+
+// record 记录一次上传，审计失败只写日志，不改变上传本身的结果
+func (a *AuditLog) record(userId, fileId, step string, err error, d time.Duration) {
+	if a == nil {
+		return
+	}
+	e := AuditEntry{UserId: userId, FileId: fileId, Step: step, Outcome: AuditSucceeded, Duration: d}
+	if err != nil {
+		e.Outcome, e.Kind = AuditFailed, KindOf(err).String()
+	}
+	if _, err := a.Append(e); err != nil {
+		slog.Error("append audit log failed",
+			slog.String("userId", userId),
+			slog.String("fileId", fileId),
+			slog.String("err", err.Error()))
+	}
+}
+
+// VerifyAuditLog 从头校验整条链，返回最后一条记录的位置。
+// want 非零时还要求链恰好结束在 want，用于发现尾部被截断。
+func VerifyAuditLog(r io.Reader, want AuditHead) (AuditHead, error) {
+	head, err := walkAuditLog(r, func(AuditHead) {})
+	if err != nil {
+		return head, err
+	}
+	if want != (AuditHead{}) && head != want {
+		return head, fmt.Errorf("%w: log ends at seq %d, expected seq %d", ErrAuditTampered, head.Seq, want.Seq)
+	}
+	return head, nil
+}
+
+// walkAuditLog 从头校验整条链，每校验通过一条记录就以它的位置调用 visit
+func walkAuditLog(r io.Reader, visit func(AuditHead)) (AuditHead, error) {
+	var head AuditHead
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return head, fmt.Errorf("%w: incomplete entry after seq %d", ErrAuditTampered, head.Seq)
+			}
+			break
+		}
+		if err != nil {
+			return head, err
+		}
+
+		var e AuditEntry
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return head, fmt.Errorf("%w: entry after seq %d: %v", ErrAuditTampered, head.Seq, err)
+		}
+		if e.Seq != head.Seq+1 || e.PrevHash != head.Hash {
+			return head, fmt.Errorf("%w: seq %d does not follow seq %d", ErrAuditTampered, e.Seq, head.Seq)
+		}
+		hash, err := e.digest()
+		if err != nil {
+			return head, err
+		}
+		if hash != e.Hash {
+			return head, fmt.Errorf("%w: seq %d hash mismatch", ErrAuditTampered, e.Seq)
+		}
+		head = AuditHead{Seq: e.Seq, Hash: e.Hash}
+		visit(head)
+	}
+	return head, nil
+}
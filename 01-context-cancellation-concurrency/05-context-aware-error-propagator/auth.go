@@ -2,75 +2,103 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 )
 
+var (
+	ErrInvalidApiKey = errors.New("invalid api key")
+	ErrInvalidUserId = errors.New("invalid user id")
+)
+
+// AuthError 只保存 API key 的指纹，原文不会出现在错误或日志中
 type AuthError struct {
-	Operation string
-	UserId    string
-	ApiKey    string
-	Err       error
-	timestamp time.Time
+	ServiceError
+	KeyFingerprint string
 }
 
 func NewAuthError(op, userId, apiKey string, err error) *AuthError {
+	return newAuthError(op, userId, Fingerprint(apiKey), err)
+}
+
+func newAuthError(op, userId, fingerprint string, err error) *AuthError {
 	return &AuthError{
-		Operation: op,
-		UserId:    userId,
-		ApiKey:    apiKey,
-		Err:       err,
-		timestamp: time.Now(),
+		ServiceError:   newServiceError(op, userId, "", err),
+		KeyFingerprint: fingerprint,
 	}
 }
 
 func (e *AuthError) Error() string {
 	return fmt.Sprintf("auth failed for user %q during %s at %s %v", e.UserId,
-		e.Operation, e.timestamp.Format(time.RFC3339), e.Err.Error())
-}
-
-func (e *AuthError) Unwrap() error {
-	return e.Err
+		e.Operation, e.timestamp.Format(time.RFC3339), e.Err)
 }
 
-func (e *AuthError) Timeout() bool {
-	switch {
-	case errors.Is(e.Err, context.DeadlineExceeded):
-		return true
+// LogValue 实现 slog.LogValuer，记录日志时只输出指纹
+func (e *AuthError) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("operation", e.Operation),
+		slog.String("userId", e.UserId),
+		slog.String("kind", e.kind.String()),
+		slog.String("keyFingerprint", e.KeyFingerprint),
+		slog.Time("timestamp", e.timestamp),
 	}
-	return false
-}
-
-func (e *AuthError) Temporary() bool {
-	switch {
-	case errors.Is(e.Err, context.DeadlineExceeded):
-		return true
+	if e.Err != nil {
+		attrs = append(attrs, slog.String("err", e.Err.Error()))
 	}
-	return false
+	return slog.GroupValue(attrs...)
 }
 
+// ValidApiKey 是未配置 KeyStore 时唯一接受的 API key
+const ValidApiKey = "valid_api_key"
+
+type AuthOption func(*AuthService)
+
 type AuthService struct {
+	keys *KeyStore
 }
 
-func NewAuthService() *AuthService {
-	return &AuthService{}
+func NewAuthService(opts ...AuthOption) *AuthService {
+	a := &AuthService{}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// WithKeyStore 使用 KeyStore 校验 API key，未设置时只接受 ValidApiKey
+func WithKeyStore(keys *KeyStore) AuthOption {
+	return func(a *AuthService) {
+		a.keys = keys
+	}
 }
 
 func (a *AuthService) Authenticate(ctx context.Context, userId, apiKey string) error {
 	if err := ctx.Err(); err != nil {
-		return NewAuthError("Authenticate", userId, apiKey, err)
+		return a.authError(userId, apiKey, err)
+	}
+	if err := a.verify(userId, apiKey); err != nil {
+		return a.authError(userId, apiKey, err)
 	}
+	return nil
+}
 
-	if apiKey != ValidApiKey {
-		return NewAuthError("Authenticate", userId, apiKey, errors.New("invalid api key"))
+// authError 用 KeyStore 的密钥计算指纹，未配置 KeyStore 时使用进程级的密钥
+func (a *AuthService) authError(userId, apiKey string, err error) *AuthError {
+	if a.keys != nil {
+		return newAuthError("Authenticate", userId, a.keys.Fingerprint(apiKey), err)
 	}
-	if userId == InvalidUserId {
-		return NewAuthError("Authenticate", userId, apiKey, errors.New("invalid user id"))
+	return NewAuthError("Authenticate", userId, apiKey, err)
+}
+
+func (a *AuthService) verify(userId, apiKey string) error {
+	if a.keys != nil {
+		return a.keys.Verify(userId, apiKey)
 	}
-	if userId == TimeoutUserId {
-		return NewAuthError("Authenticate", userId, apiKey, context.DeadlineExceeded)
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(ValidApiKey)) != 1 {
+		return ErrInvalidApiKey
 	}
-
 	return nil
 }
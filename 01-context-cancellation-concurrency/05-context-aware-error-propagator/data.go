@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -14,79 +15,226 @@ func (e *DeadlockError) Error() string {
 	return "database deadlock"
 }
 
+// Kind 死锁事务已被数据库回滚，重试即可
+func (e *DeadlockError) Kind() Kind {
+	return KindAborted
+}
+
 type MetadataError struct {
-	Operation string
-	UserId    string
-	FileId    string
-	timestamp time.Time
-	Err       error
+	ServiceError
 }
 
 func NewMetadataError(op, userId, fileId string, err error) *MetadataError {
 	return &MetadataError{
-		Operation: op,
-		UserId:    userId,
-		FileId:    fileId,
-		timestamp: time.Now(),
-		Err:       err,
+		ServiceError: newServiceError(op, userId, fileId, err),
 	}
 }
 
 func (e *MetadataError) Error() string {
-	return fmt.Sprintf("metadata failed for user %q file %q during %s at %s", e.UserId,
-		e.FileId, e.Operation, e.timestamp.Format(time.RFC3339))
+	return fmt.Sprintf("metadata failed for user %q file %q during %s at %s %v", e.UserId,
+		e.FileId, e.Operation, e.timestamp.Format(time.RFC3339), e.Err)
 }
 
-func (e *MetadataError) Unwrap() error {
-	return e.Err
+type MetadataOption func(*MetadataService)
+
+// MetadataService 保存文件元数据，写入时按版本号做 compare-and-swap
+type MetadataService struct {
+	mu    sync.Mutex
+	store metadataStore
 }
 
-func (e *MetadataError) Timeout() bool {
-	return errors.Is(e.Err, context.DeadlineExceeded)
+func NewMetadataService(opts ...MetadataOption) *MetadataService {
+	m := &MetadataService{
+		store: newMemoryStore(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
-func (e *MetadataError) Temporary() bool {
-	if e.Err == nil {
-		return false
+// WithMetadataDir 把元数据以 JSON 文件的形式持久化到 dir 下
+func WithMetadataDir(dir string) MetadataOption {
+	return func(m *MetadataService) {
+		m.store = &fileStore{dir: dir}
 	}
+}
 
-	if errors.Is(e.Err, context.DeadlineExceeded) {
-		return true
+// SaveMetadata 创建或更新 userId/fileId 的记录
+func (m *MetadataService) SaveMetadata(ctx context.Context, userId, fileId string) error {
+	_, err := m.ReplaceMetadata(ctx, userId, fileId)
+	return err
+}
+
+// ReplaceMetadata 与 SaveMetadata 相同，记录已存在时另外返回写入前的记录，供补偿时恢复
+func (m *MetadataService) ReplaceMetadata(ctx context.Context, userId, fileId string) (*FileRecord, error) {
+	if ctx.Err() != nil {
+		return nil, NewMetadataError("SaveMetadata", userId, fileId, ctx.Err())
 	}
 
-	var deadlock *DeadlockError
-	if errors.As(e.Err, &deadlock) {
-		return true
+	var prev *FileRecord
+	rec, err := m.Get(ctx, userId, fileId)
+	switch {
+	case err == nil:
+		prev = &rec
+	case errors.Is(err, ErrMetadataNotFound):
+		rec = FileRecord{UserId: userId, FileId: fileId, Owner: userId}
+	default:
+		return nil, err
 	}
 
-	var t interface{ Temporary() bool }
-	if errors.As(e.Err, &t) {
-		return t.Temporary()
+	if _, err := m.put("SaveMetadata", rec, rec.Version); err != nil {
+		return nil, err
 	}
+	return prev, nil
+}
 
-	return false
+// Put 写入记录，仅当当前版本等于 expectedVersion 时成功（0 表示记录必须不存在），
+// 返回写入后的记录。版本不匹配时返回包装了 *VersionConflictError 的 MetadataError。
+func (m *MetadataService) Put(ctx context.Context, rec FileRecord, expectedVersion int64) (FileRecord, error) {
+	if ctx.Err() != nil {
+		return FileRecord{}, NewMetadataError("Put", rec.UserId, rec.FileId, ctx.Err())
+	}
+	return m.put("Put", rec, expectedVersion)
 }
 
-type MetadataService struct {
+func (m *MetadataService) put(op string, rec FileRecord, expectedVersion int64) (FileRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var actual int64
+	cur, err := m.store.get(rec.UserId, rec.FileId)
+	switch {
+	case err == nil:
+		actual = cur.Version
+	case !errors.Is(err, ErrMetadataNotFound):
+		return FileRecord{}, NewMetadataError(op, rec.UserId, rec.FileId, err)
+	}
+	if actual != expectedVersion {
+		return FileRecord{}, NewMetadataError(op, rec.UserId, rec.FileId,
+			&VersionConflictError{Expected: expectedVersion, Actual: actual})
+	}
+
+	now := time.Now()
+	if actual == 0 {
+		rec.CreatedAt = now
+	} else {
+		rec.CreatedAt = cur.CreatedAt
+	}
+	if rec.Owner == "" {
+		rec.Owner = rec.UserId
+	}
+	rec.Version = actual + 1
+	rec.UpdatedAt = now
+
+	if err := m.store.put(rec); err != nil {
+		return FileRecord{}, NewMetadataError(op, rec.UserId, rec.FileId, err)
+	}
+	return rec, nil
 }
 
-func NewMetadataService() *MetadataService {
-	return &MetadataService{}
+func (m *MetadataService) Get(ctx context.Context, userId, fileId string) (FileRecord, error) {
+	if ctx.Err() != nil {
+		return FileRecord{}, NewMetadataError("Get", userId, fileId, ctx.Err())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, err := m.store.get(userId, fileId)
+	if err != nil {
+		return FileRecord{}, NewMetadataError("Get", userId, fileId, err)
+	}
+	return rec, nil
 }
 
-func (m *MetadataService) SaveMetadata(ctx context.Context, userId, fileId string) error {
+// List 按 fileId 排序返回用户的所有记录
+func (m *MetadataService) List(ctx context.Context, userId string) ([]FileRecord, error) {
 	if ctx.Err() != nil {
-		return NewMetadataError("SaveMetadata", userId, fileId, ctx.Err())
+		return nil, NewMetadataError("List", userId, "", ctx.Err())
 	}
-	if fileId == InvalidFileId {
-		return NewMetadataError("SaveMetadata", userId, fileId, errors.New("invalid fileId"))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recs, err := m.store.list(userId)
+	if err != nil {
+		return nil, NewMetadataError("List", userId, "", err)
 	}
-	if fileId == TimeoutFileId {
-		return NewMetadataError("SaveMetadata", userId, fileId, context.DeadlineExceeded)
+	sortRecords(recs)
+	return recs, nil
+}
+
+// Delete 删除记录，expectedVersion 为 0 时不检查版本
+func (m *MetadataService) Delete(ctx context.Context, userId, fileId string, expectedVersion int64) error {
+	if ctx.Err() != nil {
+		return NewMetadataError("Delete", userId, fileId, ctx.Err())
 	}
-	if fileId == DeadlockFileId {
-		return NewMetadataError("SaveMetadata", userId, fileId, &DeadlockError{})
+	return m.delete("Delete", userId, fileId, expectedVersion)
+}
+
+// DeleteMetadata 删除已保存的元数据，用于上传失败后的补偿
+func (m *MetadataService) DeleteMetadata(ctx context.Context, userId, fileId string) error {
+	if ctx.Err() != nil {
+		return NewMetadataError("DeleteMetadata", userId, fileId, ctx.Err())
+	}
+	return m.delete("DeleteMetadata", userId, fileId, 0)
+}
+
+// RestoreMetadata 把记录恢复为 prev 的内容，用于覆盖已有文件失败后的补偿。
+// 版本号在当前版本上继续递增，持有中间版本的写入者会得到版本冲突。
+func (m *MetadataService) RestoreMetadata(ctx context.Context, prev FileRecord) error {
+	if ctx.Err() != nil {
+		return NewMetadataError("RestoreMetadata", prev.UserId, prev.FileId, ctx.Err())
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var actual int64
+	cur, err := m.store.get(prev.UserId, prev.FileId)
+	switch {
+	case err == nil:
+		actual = cur.Version
+	case !errors.Is(err, ErrMetadataNotFound):
+		return NewMetadataError("RestoreMetadata", prev.UserId, prev.FileId, err)
+	}
+
+	prev.Version = max(actual, prev.Version) + 1
+	prev.UpdatedAt = time.Now()
+	if err := m.store.put(prev); err != nil {
+		return NewMetadataError("RestoreMetadata", prev.UserId, prev.FileId, err)
+	}
+	return nil
+}
+
+func (m *MetadataService) delete(op, userId, fileId string, expectedVersion int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if expectedVersion != 0 {
+		var actual int64
+		cur, err := m.store.get(userId, fileId)
+		switch {
+		case err == nil:
+			actual = cur.Version
+		case !errors.Is(err, ErrMetadataNotFound):
+			return NewMetadataError(op, userId, fileId, err)
+		}
+		if actual != expectedVersion {
+			return NewMetadataError(op, userId, fileId,
+				&VersionConflictError{Expected: expectedVersion, Actual: actual})
+		}
+	}
+
+	if err := m.store.delete(userId, fileId); err != nil {
+		return NewMetadataError(op, userId, fileId, err)
+	}
 	return nil
 }
+
+func (m *MetadataService) HasMetadata(userId, fileId string) bool {
+	_, err := m.Get(context.Background(), userId, fileId)
+	return err == nil
+}
+
+func metadataKey(userId, fileId string) string {
+	return userId + "/" + fileId
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// maxErrorDepth 防止自引用的错误链无限展开
+const maxErrorDepth = 32
+
+// ErrorNode 是错误树中的一层。只有实现了对应方法的层才会带上 Kind、Timeout 与 Temporary，
+// Message 只出现在没有下一层的根因上，包装层的文本总是包含了下一层的文本。
+// AuthError 层与它的 LogValue 一样只带 KeyFingerprint，不带 API key。
+type ErrorNode struct {
+	Type           string       `json:"type"`
+	Operation      string       `json:"operation,omitempty"`
+	UserId         string       `json:"userId,omitempty"`
+	FileId         string       `json:"fileId,omitempty"`
+	SessionId      string       `json:"sessionId,omitempty"`
+	KeyFingerprint string       `json:"keyFingerprint,omitempty"`
+	Attempts       int          `json:"attempts,omitempty"`
+	Kind           string       `json:"kind,omitempty"`
+	Timeout        *bool        `json:"timeout,omitempty"`
+	Temporary      *bool        `json:"temporary,omitempty"`
+	Message        string       `json:"message,omitempty"`
+	Causes         []*ErrorNode `json:"causes,omitempty"`
+}
+
+// DescribeError 展开整棵错误树，包括 errors.Join 与 Unwrap() []error 产生的分支
+func DescribeError(err error) *ErrorNode {
+	if err == nil {
+		return nil
+	}
+	return describe(err, 0)
+}
+
+func describe(err error, depth int) *ErrorNode {
+	n := &ErrorNode{Type: fmt.Sprintf("%T", err)}
+
+	switch e := err.(type) {
+	case interface{ serviceError() *ServiceError }:
+		s := e.serviceError()
+		n.Operation, n.UserId, n.FileId = s.Operation, s.UserId, s.FileId
+	case *RetryError:
+		n.Operation, n.Attempts = e.Step, e.Attempts
+	}
+	switch e := err.(type) {
+	case *SessionError:
+		n.SessionId = e.SessionId
+	case *AuthError:
+		n.KeyFingerprint = e.KeyFingerprint
+	}
+	if k, ok := err.(interface{ Kind() Kind }); ok {
+		n.Kind = k.Kind().String()
+	}
+	if t, ok := err.(interface{ Timeout() bool }); ok {
+		v := t.Timeout()
+		n.Timeout = &v
+	}
+	if t, ok := err.(interface{ Temporary() bool }); ok {
+		v := t.Temporary()
+		n.Temporary = &v
+	}
+
+	var causes []error
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		if c := e.Unwrap(); c != nil {
+			causes = []error{c}
+		}
+	case interface{ Unwrap() []error }:
+		for _, c := range e.Unwrap() {
+			if c != nil {
+				causes = append(causes, c)
+			}
+		}
+	}
+
+	if len(causes) == 0 || depth >= maxErrorDepth {
+		n.Message = err.Error()
+		return n
+	}
+	for _, c := range causes {
+		n.Causes = append(n.Causes, describe(c, depth+1))
+	}
+	return n
+}
+
+// Redact 把整棵树中出现的 secret 替换为 [REDACTED] 并返回 n。
+// 错误文本来自各层的 Error()，第三方实现可能把 API key 等凭据写进去，记录日志前应先调用。
+func (n *ErrorNode) Redact(secret string) *ErrorNode {
+	if n == nil {
+		return nil
+	}
+	for _, field := range []*string{&n.Operation, &n.UserId, &n.FileId, &n.SessionId, &n.Message} {
+		*field = redact(*field, secret)
+	}
+	for _, c := range n.Causes {
+		c.Redact(secret)
+	}
+	return n
+}
+
+// RootCauses 返回所有叶子节点，即没有再包装其他错误的根因
+func (n *ErrorNode) RootCauses() []*ErrorNode {
+	if n == nil {
+		return nil
+	}
+	if len(n.Causes) == 0 {
+		return []*ErrorNode{n}
+	}
+	var roots []*ErrorNode
+	for _, c := range n.Causes {
+		roots = append(roots, c.RootCauses()...)
+	}
+	return roots
+}
+
+// LogValue 实现 slog.LogValuer：顶层额外带上 rootCause，各层按 causes.0、causes.1 嵌套
+func (n *ErrorNode) LogValue() slog.Value {
+	if n == nil {
+		return slog.Value{}
+	}
+	var msgs []string
+	for _, root := range n.RootCauses() {
+		msgs = append(msgs, root.Message)
+	}
+	attrs := append(n.attrs(), slog.String("rootCause", strings.Join(msgs, "; ")))
+	return slog.GroupValue(attrs...)
+}
+
+func (n *ErrorNode) attrs() []slog.Attr {
+	attrs := []slog.Attr{slog.String("type", n.Type)}
+	if n.Operation != "" {
+		attrs = append(attrs, slog.String("operation", n.Operation))
+	}
+	if n.UserId != "" {
+		attrs = append(attrs, slog.String("userId", n.UserId))
+	}
+	if n.FileId != "" {
+		attrs = append(attrs, slog.String("fileId", n.FileId))
+	}
+	if n.SessionId != "" {
+		attrs = append(attrs, slog.String("sessionId", n.SessionId))
+	}
+	if n.KeyFingerprint != "" {
+		attrs = append(attrs, slog.String("keyFingerprint", n.KeyFingerprint))
+	}
+	if n.Attempts != 0 {
+		attrs = append(attrs, slog.Int("attempts", n.Attempts))
+	}
+	if n.Kind != "" {
+		attrs = append(attrs, slog.String("kind", n.Kind))
+	}
+	if n.Timeout != nil {
+		attrs = append(attrs, slog.Bool("timeout", *n.Timeout))
+	}
+	if n.Temporary != nil {
+		attrs = append(attrs, slog.Bool("temporary", *n.Temporary))
+	}
+	if n.Message != "" {
+		attrs = append(attrs, slog.String("message", n.Message))
+	}
+	if len(n.Causes) > 0 {
+		causes := make([]slog.Attr, len(n.Causes))
+		for i, c := range n.Causes {
+			causes[i] = slog.GroupAttrs(strconv.Itoa(i), c.attrs()...)
+		}
+		attrs = append(attrs, slog.GroupAttrs("causes", causes...))
+	}
+	return attrs
+}
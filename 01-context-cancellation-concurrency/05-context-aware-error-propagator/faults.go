@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// errInjected 是 "internal" 故障注入的错误，不属于任何已知类别
+var errInjected = errors.New("injected fault")
+
+// faultErrors 是规则中可以按名字引用的错误，覆盖各个错误类别的典型原因
+var faultErrors = map[string]func() error{
+	"deadline_exceeded": func() error { return context.DeadlineExceeded },
+	"canceled":          func() error { return context.Canceled },
+	"deadlock":          func() error { return &DeadlockError{} },
+	"unauthenticated":   func() error { return ErrInvalidApiKey },
+	"permission_denied": func() error { return ErrInvalidUserId },
+	"quota_exceeded":    func() error { return ErrQuotaExceeded },
+	"unavailable":       func() error { return temporaryFault{} },
+	"internal":          func() error { return errInjected },
+}
+
+// temporaryFault 模拟下游暂时不可用
+type temporaryFault struct{}
+
+func (temporaryFault) Error() string   { return "injected fault: service unavailable" }
+func (temporaryFault) Temporary() bool { return true }
+
+// FaultRule 描述一条故障注入规则。Op、UserId、FileId 是 path.Match 模式，为空时匹配任意值；
+// Op 形如 "auth.Authenticate"、"metadata.SaveMetadata"、"storage.UploadFile"。
+// 规则命中后先等待 Latency，再返回 Err（为空时按 Error 名字查找，两者都为空则只注入延迟）。
+// Probability 为 0 时总是命中，Count 为 0 时不限次数。
+type FaultRule struct {
+	Op          string        `json:"op,omitempty"`
+	UserId      string        `json:"userId,omitempty"`
+	FileId      string        `json:"fileId,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Err         error         `json:"-"`
+	Latency     time.Duration `json:"latency,omitempty"`
+	Probability float64       `json:"probability,omitempty"`
+	Count       int           `json:"count,omitempty"`
+}
+
+// UnmarshalJSON 让 latency 可以写成 "150ms" 这样的字符串
+func (r *FaultRule) UnmarshalJSON(data []byte) error {
+	type plain FaultRule
+	aux := struct {
+		*plain
+		Latency string `json:"latency,omitempty"`
+	}{plain: (*plain)(r)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Latency != "" {
+		d, err := time.ParseDuration(aux.Latency)
+		if err != nil {
+			return fmt.Errorf("latency: %w", err)
+		}
+		r.Latency = d
+	}
+	return nil
+}
+
+func (r *FaultRule) matches(op, userId, fileId string) bool {
+	return matchPattern(r.Op, op) && matchPattern(r.UserId, userId) && matchPattern(r.FileId, fileId)
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+type FaultOption func(*FaultInjector)
+
+// FaultInjector 按规则在服务操作开始前注入延迟或错误，用于在测试和演练中复现故障，
+// 通过 NewFaultyAuth 等装饰器包装服务，真正的服务实现不感知故障注入。
+// nil 的 *FaultInjector 不注入任何故障。
+type FaultInjector struct {
+	clock Clock
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	rules []FaultRule
+	fired []int
+}
+
+// NewFaultInjector 校验规则并创建注入器，按顺序匹配，第一条命中的规则生效
+func NewFaultInjector(rules []FaultRule, opts ...FaultOption) (*FaultInjector, error) {
+	f := &FaultInjector{
+		clock: realClock{},
+		rand:  rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		rules: make([]FaultRule, len(rules)),
+		fired: make([]int, len(rules)),
+	}
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("fault rule %d: %w", i, err)
+		}
+		if rule.Err == nil && rule.Error != "" {
+			rule.Err = faultErrors[rule.Error]()
+		}
+		f.rules[i] = rule
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f, nil
+}
+
+// LoadFaultRules 从 JSON 文件读取规则数组
+func LoadFaultRules(name string) ([]FaultRule, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var rules []FaultRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", name, err)
+	}
+	return rules, nil
+}
+
+func WithFaultClock(clock Clock) FaultOption {
+	return func(f *FaultInjector) {
+		f.clock = clock
+	}
+}
+
+// WithFaultSeed 固定随机种子，让按概率命中的规则可以复现
+func WithFaultSeed(seed uint64) FaultOption {
+	return func(f *FaultInjector) {
+		f.rand = rand.New(rand.NewPCG(seed, seed))
+	}
+}
+
+func (r *FaultRule) validate() error {
+	for _, pattern := range []string{r.Op, r.UserId, r.FileId} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+	}
+	if _, ok := faultErrors[r.Error]; r.Error != "" && !ok {
+		return fmt.Errorf("unknown error %q", r.Error)
+	}
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("probability %v out of range [0, 1]", r.Probability)
+	}
+	if r.Latency < 0 || r.Count < 0 {
+		return errors.New("latency and count must not be negative")
+	}
+	return nil
+}
+
+// Fired 返回第 i 条规则已经命中的次数
+func (f *FaultInjector) Fired(i int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fired[i]
+}
+
+// inject 在操作开始前调用，返回 nil 表示继续执行真正的操作
+func (f *FaultInjector) inject(ctx context.Context, op, userId, fileId string) error {
+	if f == nil {
+		return nil
+	}
+	rule, ok := f.match(op, userId, fileId)
+	if !ok {
+		return nil
+	}
+
+	if rule.Latency > 0 {
+		select {
+		case <-f.clock.After(rule.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return rule.Err
+}
+
+func (f *FaultInjector) match(op, userId, fileId string) (FaultRule, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, rule := range f.rules {
+		if !rule.matches(op, userId, fileId) {
+			continue
+		}
+		if rule.Count > 0 && f.fired[i] >= rule.Count {
+			continue
+		}
+		if rule.Probability > 0 && f.rand.Float64() >= rule.Probability {
+			continue
+		}
+		f.fired[i]++
+		return rule, true
+	}
+	return FaultRule{}, false
+}
+
+// faultyAuth 在认证前按规则注入故障，操作名为 auth.Authenticate
+type faultyAuth struct {
+	Authenticator
+	faults *FaultInjector
+}
+
+// NewFaultyAuth 返回在 auth 之前注入故障的 Authenticator
+func NewFaultyAuth(auth Authenticator, faults *FaultInjector) Authenticator {
+	return &faultyAuth{Authenticator: auth, faults: faults}
+}
+
+func (a *faultyAuth) Authenticate(ctx context.Context, userId, apiKey string) error {
+	if err := a.faults.inject(ctx, "auth.Authenticate", userId, ""); err != nil {
+		return NewAuthError("Authenticate", userId, apiKey, err)
+	}
+	return a.Authenticator.Authenticate(ctx, userId, apiKey)
+}
+
+// faultyMetadata 在每个操作前按规则注入故障，操作名形如 metadata.SaveMetadata
+type faultyMetadata struct {
+	Metadata
+	faults *FaultInjector
+}
+
+// NewFaultyMetadata 返回在 meta 的每个操作之前注入故障的 Metadata
+func NewFaultyMetadata(meta Metadata, faults *FaultInjector) Metadata {
+	return &faultyMetadata{Metadata: meta, faults: faults}
+}
+
+func (m *faultyMetadata) inject(ctx context.Context, op, userId, fileId string) error {
+	if err := m.faults.inject(ctx, "metadata."+op, userId, fileId); err != nil {
+		return NewMetadataError(op, userId, fileId, err)
+	}
+	return nil
+}
+
+func (m *faultyMetadata) ReplaceMetadata(ctx context.Context, userId, fileId string) (*FileRecord, error) {
+	if err := m.inject(ctx, "SaveMetadata", userId, fileId); err != nil {
+		return nil, err
+	}
+	return m.Metadata.ReplaceMetadata(ctx, userId, fileId)
+}
+
+func (m *faultyMetadata) Get(ctx context.Context, userId, fileId string) (FileRecord, error) {
+	if err := m.inject(ctx, "Get", userId, fileId); err != nil {
+		return FileRecord{}, err
+	}
+	return m.Metadata.Get(ctx, userId, fileId)
+}
+
+func (m *faultyMetadata) Put(ctx context.Context, rec FileRecord, expectedVersion int64) (FileRecord, error) {
+	if err := m.inject(ctx, "Put", rec.UserId, rec.FileId); err != nil {
+		return FileRecord{}, err
+	}
+	return m.Metadata.Put(ctx, rec, expectedVersion)
+}
+
+func (m *faultyMetadata) DeleteMetadata(ctx context.Context, userId, fileId string) error {
+	if err := m.inject(ctx, "DeleteMetadata", userId, fileId); err != nil {
+		return err
+	}
+	return m.Metadata.DeleteMetadata(ctx, userId, fileId)
+}
+
+func (m *faultyMetadata) RestoreMetadata(ctx context.Context, prev FileRecord) error {
+	if err := m.inject(ctx, "RestoreMetadata", prev.UserId, prev.FileId); err != nil {
+		return err
+	}
+	return m.Metadata.RestoreMetadata(ctx, prev)
+}
+
+// faultyStorage 在每个操作前按规则注入故障，操作名形如 storage.UploadFile
+type faultyStorage struct {
+	Storage
+	faults *FaultInjector
+}
+
+// NewFaultyStorage 返回在 storage 的每个操作之前注入故障的 Storage
+func NewFaultyStorage(storage Storage, faults *FaultInjector) Storage {
+	return &faultyStorage{Storage: storage, faults: faults}
+}
+
+func (s *faultyStorage) inject(ctx context.Context, op, userId, fileId string) error {
+	if err := s.faults.inject(ctx, "storage."+op, userId, fileId); err != nil {
+		return NewStorageQuotaError(op, userId, fileId, err)
+	}
+	return nil
+}
+
+func (s *faultyStorage) ReplaceFile(ctx context.Context, userId, fileId string, r io.Reader) (*BlobRef, error) {
+	if err := s.inject(ctx, "UploadFile", userId, fileId); err != nil {
+		return nil, err
+	}
+	return s.Storage.ReplaceFile(ctx, userId, fileId, r)
+}
+
+func (s *faultyStorage) Stat(ctx context.Context, userId, fileId string) (BlobRef, error) {
+	if err := s.inject(ctx, "Stat", userId, fileId); err != nil {
+		return BlobRef{}, err
+	}
+	return s.Storage.Stat(ctx, userId, fileId)
+}
+
+func (s *faultyStorage) Open(ctx context.Context, userId, fileId string) (io.ReadCloser, error) {
+	if err := s.inject(ctx, "Open", userId, fileId); err != nil {
+		return nil, err
+	}
+	return s.Storage.Open(ctx, userId, fileId)
+}
+
+func (s *faultyStorage) DeleteFile(ctx context.Context, userId, fileId string) error {
+	if err := s.inject(ctx, "DeleteFile", userId, fileId); err != nil {
+		return err
+	}
+	return s.Storage.DeleteFile(ctx, userId, fileId)
+}
+
+func (s *faultyStorage) RestoreFile(ctx context.Context, userId, fileId string, ref BlobRef) error {
+	if err := s.inject(ctx, "RestoreFile", userId, fileId); err != nil {
+		return err
+	}
+	return s.Storage.RestoreFile(ctx, userId, fileId, ref)
+}
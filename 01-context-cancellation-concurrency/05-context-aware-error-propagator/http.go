@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRetryAfter  = time.Second
+	problemContentType = "application/problem+json"
+)
+
+// Problem RFC 9457 错误响应体
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+type UploadHandlerOption func(*UploadHandler)
+
+// UploadHandler 以流的方式接收 multipart 或原始请求体上传，并把服务层错误映射为 HTTP 状态码
+//
+//	PUT  /users/{userId}/files/{fileId}  原始请求体
+//	POST /users/{userId}/files/{fileId}  multipart/form-data，读取名为 file 的字段
+//
+// API key 通过 X-API-Key 或 Authorization: Bearer 传递；
+// 带 Idempotency-Key 时，相同 key 的重复请求只执行一次。
+type UploadHandler struct {
+	upload     *UploadFileService
+	retryAfter time.Duration
+	log        *slog.Logger
+	mux        *http.ServeMux
+}
+
+func NewUploadHandler(upload *UploadFileService, opts ...UploadHandlerOption) *UploadHandler {
+	h := &UploadHandler{
+		upload:     upload,
+		retryAfter: DefaultRetryAfter,
+		log:        slog.Default(),
+		mux:        http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.mux.HandleFunc("PUT /users/{userId}/files/{fileId}", h.handleRaw)
+	h.mux.HandleFunc("POST /users/{userId}/files/{fileId}", h.handleMultipart)
+	return h
+}
+
+func WithRetryAfter(d time.Duration) UploadHandlerOption {
+	return func(h *UploadHandler) {
+		h.retryAfter = d
+	}
+}
+
+func WithLogger(log *slog.Logger) UploadHandlerOption {
+	return func(h *UploadHandler) {
+		h.log = log
+	}
+}
+
+func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *UploadHandler) handleRaw(w http.ResponseWriter, r *http.Request) {
+	h.serveUpload(w, r, r.Body, r.Header.Get("Content-Type"))
+}
+
+func (h *UploadHandler) handleMultipart(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		h.writeProblem(w, r, http.StatusUnsupportedMediaType, "expected multipart/form-data")
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		h.writeProblem(w, r, http.StatusBadRequest, "malformed multipart body")
+		return
+	}
+
+	// 不使用 ParseMultipartForm，避免把整个文件缓存到内存或临时文件
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			h.writeProblem(w, r, http.StatusBadRequest, `missing "file" part`)
+			return
+		}
+		if err != nil {
+			h.writeProblem(w, r, http.StatusBadRequest, "malformed multipart body")
+			return
+		}
+		if part.FormName() == "file" {
+			h.serveUpload(w, r, part, part.Header.Get("Content-Type"))
+			part.Close()
+			return
+		}
+		part.Close()
+	}
+}
+
+// serveUpload 上传 body，contentType 取自原始请求或 file 字段的 Content-Type，无法解析时不记录
+func (h *UploadHandler) serveUpload(w http.ResponseWriter, r *http.Request, body io.Reader, contentType string) {
+	userId, fileId := r.PathValue("userId"), r.PathValue("fileId")
+	apiKey := apiKeyFromRequest(r)
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
+	rec := &UploadRecord{UserId: userId, FileId: fileId, apiKey: apiKey, Body: body}
+	if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+		rec.ContentType = mime.FormatMediaType(mediaType, params)
+	}
+
+	start := time.Now()
+	err := h.upload.uploadIdempotent(r.Context(), idempotencyKey, rec)
+	if err != nil {
+		status := h.statusFor(w, err)
+		h.log.Error("upload file failed",
+			slog.String("userId", userId),
+			slog.String("fileId", fileId),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.Any("err", DescribeError(err).Redact(apiKey)))
+		h.writeProblem(w, r, status, redact(problemDetail(status), apiKey))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"userId": userId,
+		"fileId": fileId,
+	})
+}
+
+// statusFor 按错误类别选择状态码，不做任何字符串匹配
+func (h *UploadHandler) statusFor(w http.ResponseWriter, err error) int {
+	if IsRetryable(err) {
+		seconds := max(1, int(h.retryAfter.Round(time.Second)/time.Second))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		return http.StatusServiceUnavailable
+	}
+
+	switch KindOf(err) {
+	case KindUnauthenticated:
+		return http.StatusUnauthorized
+	case KindPermissionDenied:
+		return http.StatusForbidden
+	case KindResourceExhausted:
+		if errors.Is(err, ErrFileTooLarge) {
+			return http.StatusRequestEntityTooLarge
+		}
+		return http.StatusInsufficientStorage
+	case KindInvalidArgument:
+		return http.StatusBadRequest
+	case KindFailedPrecondition:
+		if errors.Is(err, ErrIdempotencyConflict) {
+			return http.StatusUnprocessableEntity
+		}
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func (h *UploadHandler) writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+// problemDetail 只返回固定文案，服务层错误的细节只写入服务端日志
+func problemDetail(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return "the api key is missing or invalid"
+	case http.StatusForbidden:
+		return "the user is not allowed to upload files"
+	case http.StatusServiceUnavailable:
+		return "the upload failed temporarily, retry later"
+	case http.StatusRequestEntityTooLarge:
+		return "the file is larger than the storage quota"
+	case http.StatusInsufficientStorage:
+		return "the storage quota has been exhausted"
+	case http.StatusBadRequest:
+		return "the user id or file id is invalid"
+	case http.StatusUnprocessableEntity:
+		return "the idempotency key was already used for a different request"
+	case http.StatusConflict:
+		return "the request conflicts with the current state of the file"
+	}
+	return "the upload failed"
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return ""
+}
+
+func redact(s, secret string) string {
+	if secret == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, secret, "[REDACTED]")
+}
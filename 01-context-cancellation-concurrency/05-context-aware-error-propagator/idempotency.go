@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrIdempotencyConflict = errors.New("idempotency key reused with a different request")
+	// ErrIdempotencyAborted 表示第一次请求没有留下可重放的结果，重复请求需要用同一个 key 重试
+	ErrIdempotencyAborted = errors.New("idempotent request finished without a replayable result")
+)
+
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// idempotencyEntry 记录某个 key 第一次请求的结果，done 关闭后 fingerprint 与 err 才可读
+type idempotencyEntry struct {
+	done        chan struct{}
+	fingerprint string
+	err         error
+	expiresAt   time.Time
+}
+
+type IdempotencyOption func(*idempotencyStore)
+
+type idempotencyStore struct {
+	window time.Duration
+	clock  Clock
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	nextSweep time.Time
+}
+
+func newIdempotencyStore(opts ...IdempotencyOption) *idempotencyStore {
+	s := &idempotencyStore{
+		window:  DefaultIdempotencyWindow,
+		clock:   realClock{},
+		entries: make(map[string]*idempotencyEntry),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithIdempotencyWindow 设置 key 在请求完成后保留多久
+func WithIdempotencyWindow(window time.Duration) IdempotencyOption {
+	return func(s *idempotencyStore) {
+		s.window = window
+	}
+}
+
+func WithIdempotencyClock(clock Clock) IdempotencyOption {
+	return func(s *idempotencyStore) {
+		s.clock = clock
+	}
+}
+
+// WithIdempotency 配置幂等 key 的保存策略
+func WithIdempotency(opts ...IdempotencyOption) Option {
+	return func(upload *UploadFileService) {
+		upload.idempotency = newIdempotencyStore(opts...)
+	}
+}
+
+// begin 返回 key 对应的记录，leader 为 true 表示调用方是第一个请求，需要执行并调用 finish
+func (s *idempotencyStore) begin(userId, key string) (e *idempotencyEntry, leader bool) {
+	now := s.clock.Now()
+	id := userId + "\x00" + key
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	if e, ok := s.entries[id]; ok && !e.expired(now) {
+		return e, false
+	}
+	e = &idempotencyEntry{done: make(chan struct{})}
+	s.entries[id] = e
+	return e, true
+}
+
+// finish 保存第一次请求的结果并唤醒等待的重复请求。
+// 可重试、被取消或认证失败的结果不保存，客户端稍后用同一个 key 重试时会重新执行；
+// fingerprint 为空表示没能得到完整的请求摘要，结果无法与重复请求比对，同样不保存。
+func (s *idempotencyStore) finish(userId, key string, e *idempotencyEntry, fingerprint string, err error) {
+	s.mu.Lock()
+	e.fingerprint, e.err = fingerprint, err
+	e.expiresAt = s.clock.Now().Add(s.window)
+	switch k := KindOf(err); {
+	case fingerprint == "", k.Retryable(), k == KindCanceled, k == KindUnauthenticated, k == KindPermissionDenied:
+		delete(s.entries, userId+"\x00"+key)
+	}
+	s.mu.Unlock()
+	close(e.done)
+}
+
+// sweep 定期删除过期记录，调用方需持有 s.mu
+func (s *idempotencyStore) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	for id, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, id)
+		}
+	}
+	s.nextSweep = now.Add(s.window)
+}
+
+// expired 对仍在进行中的请求总是返回 false，调用方需持有 s.mu
+func (e *idempotencyEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+func (u *UploadFileService) uploadFileIdempotent(ctx context.Context, key, userId, apiKey, fileId string, r io.Reader) error {
+	return u.uploadIdempotent(ctx, key, &UploadRecord{UserId: userId, FileId: fileId, apiKey: apiKey, Body: r})
+}
+
+// uploadIdempotent 与 upload 相同，但相同 key 与相同请求内容的重复调用只执行一次：
+// 之后的调用（包括第一次仍在进行时到达的并发调用）直接返回第一次的结果；
+// 相同 key 但内容或类型不同时返回 ErrIdempotencyConflict。key 为空时不做幂等处理。
+func (u *UploadFileService) uploadIdempotent(ctx context.Context, key string, rec *UploadRecord) error {
+	if key == "" {
+		return u.upload(ctx, rec)
+	}
+	userId, r := rec.UserId, rec.Body
+
+	// 先认证再占用 key：否则知道 key 的人无需凭据就能得到别人的结果，
+	// 凭据错误的第一次请求也会让 key 在整个窗口内只能重放认证失败
+	if err := u.authenticate(ctx, rec); err != nil {
+		return err
+	}
+
+	e, leader := u.idempotency.begin(userId, key)
+	if !leader {
+		return u.awaitIdempotent(ctx, e, key, rec)
+	}
+
+	var (
+		fingerprint string
+		err         error
+	)
+	defer func() {
+		u.idempotency.finish(userId, key, e, fingerprint, err)
+	}()
+
+	// 可 Seek 的内容先算摘要再倒回开头，保留存储层重试的能力；否则边上传边算
+	if s, ok := r.(io.Seeker); ok {
+		fp, fpErr := requestFingerprint(ctx, rec)
+		if fpErr == nil {
+			_, fpErr = s.Seek(0, io.SeekStart)
+		}
+		if fpErr != nil {
+			err = fpErr
+			return err
+		}
+		fingerprint = fp
+		err = u.upload(ctx, rec)
+		return err
+	}
+
+	// 上传提前失败时内容可能没读完，摘要不完整，这次结果不保存；
+	// 不为了补全摘要去读完剩余内容，请求体的大小没有上限
+	h := sha256.New()
+	rec.Body = io.TeeReader(r, h)
+	if err = u.upload(ctx, rec); err != nil {
+		return err
+	}
+	fingerprint = fingerprintOf(rec, hex.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
+func (u *UploadFileService) awaitIdempotent(ctx context.Context, e *idempotencyEntry, key string, rec *UploadRecord) error {
+	fingerprint, err := requestFingerprint(ctx, rec)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return fmt.Errorf("wait for idempotent request: %w", ctx.Err())
+	}
+
+	if e.fingerprint == "" {
+		return fmt.Errorf("%w: key %q", ErrIdempotencyAborted, key)
+	}
+	if e.fingerprint != fingerprint {
+		return fmt.Errorf("%w: key %q", ErrIdempotencyConflict, key)
+	}
+	return e.err
+}
+
+// requestFingerprint 读完请求内容，返回 userId、fileId、内容类型与内容摘要共同决定的指纹
+func requestFingerprint(ctx context.Context, rec *UploadRecord) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, &ctxReader{ctx: ctx, r: rec.Body}); err != nil {
+		return "", err
+	}
+	return fingerprintOf(rec, hex.EncodeToString(h.Sum(nil))), nil
+}
+
+func fingerprintOf(rec *UploadRecord, digest string) string {
+	sum := sha256.Sum256([]byte(rec.UserId + "\x00" + rec.FileId + "\x00" + rec.ContentType + "\x00" + digest))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	saltSize   = 16
+	secretSize = 32
+)
+
+var ErrKeyNotFound = errors.New("api key not found")
+
+// storedKey 只保存加盐哈希，不保存 API key 原文
+type storedKey struct {
+	id        string
+	salt      []byte
+	hash      [sha256.Size]byte
+	expiresAt time.Time
+}
+
+func (k *storedKey) expired(now time.Time) bool {
+	return !k.expiresAt.IsZero() && !now.Before(k.expiresAt)
+}
+
+// KeyStore 为每个用户保存多个有效 API key，用于无中断轮换
+type KeyStore struct {
+	mu    sync.RWMutex
+	keys  map[string][]*storedKey
+	clock Clock
+
+	// dummy 用于未知用户的比较，避免通过耗时判断用户是否存在
+	dummy storedKey
+	// secret 是计算指纹的 HMAC 密钥，每个 KeyStore 随机生成，不持久化
+	secret []byte
+}
+
+func NewKeyStore(clock Clock) *KeyStore {
+	if clock == nil {
+		clock = realClock{}
+	}
+	s := &KeyStore{
+		keys:  make(map[string][]*storedKey),
+		clock: clock,
+	}
+	s.dummy.salt = make([]byte, saltSize)
+	rand.Read(s.dummy.salt)
+	s.secret = make([]byte, secretSize)
+	rand.Read(s.secret)
+	return s
+}
+
+// AddKey 为用户添加一个 API key，expiresAt 为零值表示永不过期，返回 key 的 ID
+func (s *KeyStore) AddKey(userId, apiKey string, expiresAt time.Time) string {
+	salt := make([]byte, saltSize)
+	rand.Read(salt)
+	k := &storedKey{
+		id:        newKeyId(),
+		salt:      salt,
+		hash:      hashKey(salt, apiKey),
+		expiresAt: expiresAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[userId] = append(s.prune(userId), k)
+	return k.id
+}
+
+// Rotate 添加新 key，并让用户现有的 key 在 grace 之后过期，
+// 客户端可以在宽限期内逐步切换到新 key。
+func (s *KeyStore) Rotate(userId, newKey string, ttl, grace time.Duration) string {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	deadline := now.Add(grace)
+	for _, k := range s.prune(userId) {
+		if k.expiresAt.IsZero() || k.expiresAt.After(deadline) {
+			k.expiresAt = deadline
+		}
+	}
+	s.mu.Unlock()
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = now.Add(ttl)
+	}
+	return s.AddKey(userId, newKey, expiresAt)
+}
+
+// RevokeKey 立即吊销指定的 key
+func (s *KeyStore) RevokeKey(userId, keyId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := s.keys[userId]
+	for i, k := range keys {
+		if k.id == keyId {
+			s.keys[userId] = append(keys[:i:i], keys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrKeyNotFound
+}
+
+// Verify 检查 apiKey 是否是该用户当前有效的 key。
+// 会与用户所有的 key 逐一做常量时间比较，不会在第一次匹配时提前返回。
+func (s *KeyStore) Verify(userId, apiKey string) error {
+	now := s.clock.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := s.keys[userId]
+	if len(keys) == 0 {
+		h := hashKey(s.dummy.salt, apiKey)
+		subtle.ConstantTimeCompare(h[:], s.dummy.hash[:])
+		return ErrInvalidApiKey
+	}
+
+	match := 0
+	for _, k := range keys {
+		h := hashKey(k.salt, apiKey)
+		ok := subtle.ConstantTimeCompare(h[:], k.hash[:])
+		if k.expired(now) {
+			ok = 0
+		}
+		match |= ok
+	}
+	if match != 1 {
+		return ErrInvalidApiKey
+	}
+	return nil
+}
+
+// prune 删除用户已过期的 key，调用方需持有写锁
+func (s *KeyStore) prune(userId string) []*storedKey {
+	now := s.clock.Now()
+	keys := s.keys[userId][:0:0]
+	for _, k := range s.keys[userId] {
+		if !k.expired(now) {
+			keys = append(keys, k)
+		}
+	}
+	s.keys[userId] = keys
+	return keys
+}
+
+func hashKey(salt []byte, apiKey string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(apiKey))
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Fingerprint 返回 API key 在这个 KeyStore 下的短指纹，可以安全地出现在日志与错误中。
+// 指纹是以 KeyStore 的密钥计算的 HMAC，不知道密钥就无法离线枚举出 key。
+func (s *KeyStore) Fingerprint(apiKey string) string {
+	return fingerprint(s.secret, apiKey)
+}
+
+// processSecret 用于没有 KeyStore 时的指纹，进程重启后同一个 key 的指纹会变化
+var processSecret = func() []byte {
+	b := make([]byte, secretSize)
+	rand.Read(b)
+	return b
+}()
+
+// Fingerprint 返回 API key 在本进程内的短指纹，配置了 KeyStore 时使用 KeyStore.Fingerprint
+func Fingerprint(apiKey string) string {
+	return fingerprint(processSecret, apiKey)
+}
+
+func fingerprint(secret []byte, apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(apiKey))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func newKeyId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+// Kind 描述错误的类别，与具体是哪一层服务出错无关
+type Kind uint8
+
+const (
+	KindUnknown Kind = iota
+	KindInvalidArgument
+	KindNotFound
+	KindAlreadyExists
+	KindUnauthenticated
+	KindPermissionDenied
+	KindResourceExhausted
+	KindFailedPrecondition
+	KindAborted
+	KindUnavailable
+	KindDeadlineExceeded
+	KindCanceled
+	KindInternal
+)
+
+var kindNames = [...]string{
+	KindUnknown:            "Unknown",
+	KindInvalidArgument:    "InvalidArgument",
+	KindNotFound:           "NotFound",
+	KindAlreadyExists:      "AlreadyExists",
+	KindUnauthenticated:    "Unauthenticated",
+	KindPermissionDenied:   "PermissionDenied",
+	KindResourceExhausted:  "ResourceExhausted",
+	KindFailedPrecondition: "FailedPrecondition",
+	KindAborted:            "Aborted",
+	KindUnavailable:        "Unavailable",
+	KindDeadlineExceeded:   "DeadlineExceeded",
+	KindCanceled:           "Canceled",
+	KindInternal:           "Internal",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return "Unknown"
+}
+
+// Retryable 报告该类别的错误是否可以通过重试解决
+func (k Kind) Retryable() bool {
+	switch k {
+	case KindAborted, KindUnavailable, KindDeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// KindOf 返回错误链中最外层带有类别的错误的类别，
+// 没有任何一层声明类别时按已知的哨兵错误推断。
+func KindOf(err error) Kind {
+	if err == nil {
+		return KindUnknown
+	}
+
+	var k interface{ Kind() Kind }
+	if errors.As(err, &k) {
+		return k.Kind()
+	}
+	return classify(err)
+}
+
+// IsRetryable 报告错误链中的错误是否可以重试
+func IsRetryable(err error) bool {
+	return KindOf(err).Retryable()
+}
+
+// classify 把标准库和本包的哨兵错误映射为类别
+func classify(err error) Kind {
+	switch {
+	case err == nil:
+		return KindUnknown
+	case errors.Is(err, context.DeadlineExceeded):
+		return KindDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return KindCanceled
+	case errors.Is(err, ErrInvalidApiKey):
+		return KindUnauthenticated
+	case errors.Is(err, ErrInvalidUserId), errors.Is(err, fs.ErrPermission):
+		return KindPermissionDenied
+	case errors.Is(err, ErrQuotaExceeded):
+		return KindResourceExhausted
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrChecksumMismatch),
+		errors.Is(err, ErrChunkOutOfRange), errors.Is(err, ErrChunkTooLarge):
+		return KindInvalidArgument
+	case errors.Is(err, ErrSessionIncomplete), errors.Is(err, ErrSessionBusy), errors.Is(err, ErrIdempotencyConflict):
+		return KindFailedPrecondition
+	case errors.Is(err, ErrSessionNotFound), errors.Is(err, ErrMetadataNotFound), errors.Is(err, fs.ErrNotExist):
+		return KindNotFound
+	case errors.Is(err, fs.ErrExist):
+		return KindAlreadyExists
+	case errors.Is(err, ErrIdempotencyAborted):
+		return KindAborted
+	}
+
+	var t interface{ Temporary() bool }
+	if errors.As(err, &t) && t.Temporary() {
+		return KindUnavailable
+	}
+	return KindInternal
+}
+
+// ServiceError 是各服务层错误的公共部分：
+// 记录出错的操作与对象，并根据被包装的错误确定类别。
+type ServiceError struct {
+	Operation string
+	UserId    string
+	FileId    string
+	Err       error
+	kind      Kind
+	timestamp time.Time
+}
+
+func newServiceError(op, userId, fileId string, err error) ServiceError {
+	var kind Kind
+	if err != nil {
+		kind = KindOf(err)
+	}
+	return ServiceError{
+		Operation: op,
+		UserId:    userId,
+		FileId:    fileId,
+		Err:       err,
+		kind:      kind,
+		timestamp: time.Now(),
+	}
+}
+
+// serviceError 让 DescribeError 从嵌入了 ServiceError 的各层错误中取出公共字段
+func (e *ServiceError) serviceError() *ServiceError {
+	return e
+}
+
+func (e *ServiceError) Kind() Kind {
+	return e.kind
+}
+
+func (e *ServiceError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ServiceError) Timeout() bool {
+	return e.kind == KindDeadlineExceeded
+}
+
+func (e *ServiceError) Temporary() bool {
+	return e.kind.Retryable()
+}
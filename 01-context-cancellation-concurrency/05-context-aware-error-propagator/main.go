@@ -2,69 +2,173 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"strings"
+	"time"
 )
 
 type Option func(*UploadFileService)
 
 type UploadFileService struct {
-	auth    *AuthService
-	meta    *MetadataService
-	storage *StorageService
+	auth    Authenticator
+	meta    Metadata
+	storage Storage
+	steps   []UploadStep
+
+	compensationTimeout time.Duration
+	retry               *RetryPolicy
+	sessions            *sessionManager
+	idempotency         *idempotencyStore
+	faults              *FaultInjector
+	audit               *AuditLog
 }
 
-func NewUploadFileService(opts ...Option) *UploadFileService {
-	upload := &UploadFileService{}
+// NewUploadFileService 创建上传服务。认证、元数据与存储都必须配置，
+// 否则返回 ErrMissingStep，而不是等到第一次上传时才因为 nil 而 panic。
+func NewUploadFileService(opts ...Option) (*UploadFileService, error) {
+	upload := &UploadFileService{
+		compensationTimeout: DefaultCompensationTimeout,
+		sessions:            newSessionManager(),
+		idempotency:         newIdempotencyStore(),
+	}
 
 	for _, opt := range opts {
 		opt(upload)
 	}
-	return upload
+
+	switch {
+	case isNil(upload.auth):
+		return nil, fmt.Errorf("%w: Authenticate (no authenticator configured)", ErrMissingStep)
+	case isNil(upload.meta):
+		return nil, fmt.Errorf("%w: SaveMetadata (no metadata service configured)", ErrMissingStep)
+	case isNil(upload.storage):
+		return nil, fmt.Errorf("%w: UploadFile (no storage service configured)", ErrMissingStep)
+	}
+	if upload.faults != nil {
+		upload.auth = NewFaultyAuth(upload.auth, upload.faults)
+		upload.meta = NewFaultyMetadata(upload.meta, upload.faults)
+		upload.storage = NewFaultyStorage(upload.storage, upload.faults)
+	}
+	if upload.steps == nil {
+		upload.steps = defaultSteps(upload.auth, upload.meta, upload.storage)
+	}
+	if err := validateSteps(upload.steps); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
 }
 
-func WithAuth() Option {
+func WithAuth(opts ...AuthOption) Option {
 	return func(upload *UploadFileService) {
-		upload.auth = NewAuthService()
+		upload.auth = NewAuthService(opts...)
 	}
 }
 
-func WithMeta() Option {
+func WithMeta(opts ...MetadataOption) Option {
 	return func(upload *UploadFileService) {
-		upload.meta = NewMetadataService()
+		upload.meta = NewMetadataService(opts...)
 	}
 }
 
-func WithStorage() Option {
+func WithStorage(opts ...StorageOption) Option {
 	return func(upload *UploadFileService) {
-		upload.storage = &StorageService{}
+		upload.storage = NewStorageService(opts...)
 	}
 }
 
-func (u *UploadFileService) uploadFile(ctx context.Context, userId, apiKey, fileId string) error {
-	// 认证
-	if err := u.auth.Authenticate(ctx, userId, apiKey); err != nil {
-		return fmt.Errorf("upload file failed: %w", err)
+// WithFaults 用同一个故障注入器包装认证、元数据与存储，
+// 在所有其他选项之后生效，与服务选项的顺序无关。WithSteps 自带的步骤不会被包装。
+func WithFaults(faults *FaultInjector) Option {
+	return func(upload *UploadFileService) {
+		upload.faults = faults
 	}
+}
 
-	// 元数据
-	if err := u.meta.SaveMetadata(ctx, userId, fileId); err != nil {
-		return fmt.Errorf("upload file failed: %w", err)
+// WithCompensationTimeout 设置失败后执行补偿动作的超时时间
+func WithCompensationTimeout(timeout time.Duration) Option {
+	return func(upload *UploadFileService) {
+		upload.compensationTimeout = timeout
 	}
+}
 
-	// 存储
-	if err := u.storage.UploadFile(ctx, userId, fileId); err != nil {
-		return fmt.Errorf("upload file failed: %w", err)
+func (u *UploadFileService) uploadFile(ctx context.Context, userId, apiKey, fileId string, r io.Reader) error {
+	return u.upload(ctx, &UploadRecord{UserId: userId, FileId: fileId, apiKey: apiKey, Body: r})
+}
+
+// upload 依次执行流水线中的步骤，任何一步失败都会逆序执行已完成步骤的补偿
+func (u *UploadFileService) upload(ctx context.Context, rec *UploadRecord) (err error) {
+	s := newSaga(u.compensationTimeout)
+	rt := newRetrier(u.retry)
+	userId, fileId := rec.UserId, rec.FileId
+
+	// step 是最后开始执行的步骤，失败时即出错的步骤
+	var step string
+	start := time.Now()
+	defer func() {
+		u.audit.record(userId, fileId, step, err, time.Since(start))
+	}()
+
+	for _, st := range u.steps {
+		step = st.Name()
+		if err := u.runStep(ctx, rt, s, st, rec); err != nil {
+			return s.rollback(ctx, fmt.Errorf("upload file failed: %w", err))
+		}
 	}
+	return nil
+}
 
+// authenticate 在流水线之前认证（例如幂等请求占用 key 之前），失败同样写入审计日志
+func (u *UploadFileService) authenticate(ctx context.Context, rec *UploadRecord) error {
+	start := time.Now()
+	if err := u.auth.Authenticate(ctx, rec.UserId, rec.apiKey); err != nil {
+		err = fmt.Errorf("upload file failed: %w", err)
+		u.audit.record(rec.UserId, rec.FileId, "Authenticate", err, time.Since(start))
+		return err
+	}
+	rec.authenticated = true
 	return nil
 }
 
 func main() {
+	faultsFile := flag.String("faults", "", "JSON file with fault injection rules")
+	auditFile := flag.String("audit", "", "append-only audit log file")
+	flag.Parse()
+
+	opts := []Option{WithAuth(), WithMeta(), WithStorage()}
+	if *faultsFile != "" {
+		rules, err := LoadFaultRules(*faultsFile)
+		if err != nil {
+			slog.Error("load fault rules failed", slog.String("err", err.Error()))
+			return
+		}
+		faults, err := NewFaultInjector(rules)
+		if err != nil {
+			slog.Error("load fault rules failed", slog.String("err", err.Error()))
+			return
+		}
+		opts = append(opts, WithFaults(faults))
+	}
+	if *auditFile != "" {
+		audit, err := OpenAuditLog(*auditFile)
+		if err != nil {
+			slog.Error("open audit log failed", slog.String("err", err.Error()))
+			return
+		}
+		defer audit.Close()
+		opts = append(opts, WithAudit(audit))
+	}
 
 	ctx := context.Background()
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
-	if err := upload.uploadFile(ctx, "user123", "valid_api_key", "file123"); err != nil {
+	upload, err := NewUploadFileService(opts...)
+	if err != nil {
+		slog.Error("create upload service failed", slog.String("err", err.Error()))
+		return
+	}
+	if err := upload.uploadFile(ctx, "user123", "valid_api_key", "file123", strings.NewReader("hello")); err != nil {
 		slog.Error("upload file failed")
 		return
 	}
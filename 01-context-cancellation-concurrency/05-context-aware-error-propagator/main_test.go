@@ -1,14 +1,73 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
+// 测试场景使用的特殊 ID，对应的故障由 scenarioFaults 注入，服务本身不识别它们
+const (
+	TimeoutUserId        = "timeout_user"
+	InvalidUserId        = "invalid_user_id"
+	InvalidFileId        = "invalid_file_id"
+	TimeoutFileId        = "timeout_file_id"
+	DeadlockFileId       = "deadlock_file_id"
+	InvalidStorageUserId = "invalid_storage_user_id"
+	TimeoutStorageUserId = "timeout_storage_user_id"
+)
+
+var scenarioRules = []FaultRule{
+	{Op: "auth.Authenticate", UserId: InvalidUserId, Error: "permission_denied"},
+	{Op: "auth.Authenticate", UserId: TimeoutUserId, Error: "deadline_exceeded"},
+	{Op: "metadata.SaveMetadata", FileId: InvalidFileId, Error: "internal"},
+	{Op: "metadata.SaveMetadata", FileId: TimeoutFileId, Error: "deadline_exceeded"},
+	{Op: "metadata.SaveMetadata", FileId: DeadlockFileId, Error: "deadlock"},
+	{Op: "storage.UploadFile", UserId: InvalidStorageUserId, Error: "internal"},
+	{Op: "storage.UploadFile", UserId: TimeoutStorageUserId, Error: "deadline_exceeded"},
+}
+
+// scenarioFaults 返回按特殊 ID 注入故障的注入器
+func scenarioFaults(t *testing.T) *FaultInjector {
+	t.Helper()
+	faults, err := NewFaultInjector(scenarioRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return faults
+}
+
+// newUploadService 创建上传服务，配置错误时直接让测试失败
+func newUploadService(t *testing.T, opts ...Option) *UploadFileService {
+	t.Helper()
+	upload, err := NewUploadFileService(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upload
+}
+
 // TestSensitiveDataLeak 测试场景 1: "The Sensitive Data Leak"
 // 要求：fmt.Sprint(err) 不应包含 API key 字符串
 func TestSensitiveDataLeak(t *testing.T) {
@@ -36,14 +95,17 @@ func TestSensitiveDataLeak(t *testing.T) {
 		t.Fatal("expected AuthError, but errors.As failed")
 	}
 
-	// 验证 AuthError 内部确实包含 API key（但不应在 Error() 中暴露）
-	if authErr.ApiKey != sensitiveAPIKey {
-		t.Errorf("expected ApiKey to be %q, got %q", sensitiveAPIKey, authErr.ApiKey)
+	// 验证 AuthError 只保存 API key 的指纹
+	if authErr.KeyFingerprint != Fingerprint(sensitiveAPIKey) {
+		t.Errorf("expected KeyFingerprint to be %q, got %q", Fingerprint(sensitiveAPIKey), authErr.KeyFingerprint)
+	}
+	if strings.Contains(authErr.KeyFingerprint, sensitiveAPIKey) {
+		t.Error("fingerprint must not contain the api key")
 	}
 
 	// 验证通过 uploadFile 包装后仍然不包含 API key
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
-	wrappedErr := upload.uploadFile(context.Background(), "user123", sensitiveAPIKey, "file001")
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage())
+	wrappedErr := upload.uploadFile(context.Background(), "user123", sensitiveAPIKey, "file001", strings.NewReader("hello"))
 	if wrappedErr == nil {
 		t.Fatal("expected error from uploadFile, got nil")
 	}
@@ -68,8 +130,8 @@ func TestLostContext(t *testing.T) {
 	}
 
 	// 第一层包装：uploadFile 已经包装了一次
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
-	wrapped1 := upload.uploadFile(context.Background(), "user123", "invalid-key", "file001")
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage())
+	wrapped1 := upload.uploadFile(context.Background(), "user123", "invalid-key", "file001", strings.NewReader("hello"))
 	if wrapped1 == nil {
 		t.Fatal("expected error from uploadFile, got nil")
 	}
@@ -103,7 +165,7 @@ func TestLostContext(t *testing.T) {
 // TestTimeoutConfusion 测试场景 3: "The Timeout Confusion"
 // 要求：存储层超时错误，errors.Is(err, context.DeadlineExceeded) 应返回 true
 func TestTimeoutConfusion(t *testing.T) {
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage())
 
 	// 使用会触发存储层超时的 userId
 	err := upload.uploadFile(
@@ -111,6 +173,7 @@ func TestTimeoutConfusion(t *testing.T) {
 		TimeoutStorageUserId,
 		ValidApiKey,
 		"file001",
+		strings.NewReader("hello"),
 	)
 
 	if err == nil {
@@ -142,11 +205,11 @@ func TestTimeoutConfusion(t *testing.T) {
 
 // TestErrorWrapping 测试错误包装使用 %w
 func TestErrorWrapping(t *testing.T) {
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage())
 
 	// 测试认证层错误
 	t.Run("AuthError wrapping", func(t *testing.T) {
-		err := upload.uploadFile(context.Background(), "user123", "invalid-key", "file001")
+		err := upload.uploadFile(context.Background(), "user123", "invalid-key", "file001", strings.NewReader("hello"))
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -159,7 +222,7 @@ func TestErrorWrapping(t *testing.T) {
 
 	// 测试元数据层错误
 	t.Run("MetadataError wrapping", func(t *testing.T) {
-		err := upload.uploadFile(context.Background(), "user123", ValidApiKey, InvalidFileId)
+		err := upload.uploadFile(context.Background(), "user123", ValidApiKey, InvalidFileId, strings.NewReader("hello"))
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -172,7 +235,7 @@ func TestErrorWrapping(t *testing.T) {
 
 	// 测试存储层错误
 	t.Run("StorageQuotaError wrapping", func(t *testing.T) {
-		err := upload.uploadFile(context.Background(), InvalidStorageUserId, ValidApiKey, "file001")
+		err := upload.uploadFile(context.Background(), InvalidStorageUserId, ValidApiKey, "file001", strings.NewReader("hello"))
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -187,7 +250,7 @@ func TestErrorWrapping(t *testing.T) {
 // TestContextAwareErrors 测试 Context-Aware 错误方法
 func TestContextAwareErrors(t *testing.T) {
 	t.Run("AuthError Timeout and Temporary", func(t *testing.T) {
-		auth := NewAuthService()
+		auth := NewFaultyAuth(NewAuthService(), scenarioFaults(t))
 
 		// 测试超时错误
 		err := auth.Authenticate(context.Background(), TimeoutUserId, ValidApiKey)
@@ -229,10 +292,10 @@ func TestContextAwareErrors(t *testing.T) {
 	})
 
 	t.Run("MetadataError Timeout and Temporary", func(t *testing.T) {
-		meta := NewMetadataService()
+		meta := NewFaultyMetadata(NewMetadataService(), scenarioFaults(t))
 
 		// 测试超时错误
-		err := meta.SaveMetadata(context.Background(), "user123", TimeoutFileId)
+		_, err := meta.ReplaceMetadata(context.Background(), "user123", TimeoutFileId)
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -251,7 +314,7 @@ func TestContextAwareErrors(t *testing.T) {
 		}
 
 		// 测试死锁错误（应该是临时的）
-		err2 := meta.SaveMetadata(context.Background(), "user123", DeadlockFileId)
+		_, err2 := meta.ReplaceMetadata(context.Background(), "user123", DeadlockFileId)
 		if err2 == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -271,10 +334,10 @@ func TestContextAwareErrors(t *testing.T) {
 	})
 
 	t.Run("StorageQuotaError Timeout and Temporary", func(t *testing.T) {
-		storage := &StorageService{}
+		storage := NewFaultyStorage(NewStorageService(WithRoot(t.TempDir())), scenarioFaults(t))
 
 		// 测试超时错误
-		err := storage.UploadFile(context.Background(), TimeoutStorageUserId, "file001")
+		_, err := storage.ReplaceFile(context.Background(), TimeoutStorageUserId, "file001", strings.NewReader("hello"))
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -293,7 +356,7 @@ func TestContextAwareErrors(t *testing.T) {
 		}
 
 		// 测试非超时错误（配额错误不是临时的）
-		err2 := storage.UploadFile(context.Background(), InvalidStorageUserId, "file001")
+		_, err2 := storage.ReplaceFile(context.Background(), InvalidStorageUserId, "file001", strings.NewReader("hello"))
 		if err2 == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -315,7 +378,7 @@ func TestContextAwareErrors(t *testing.T) {
 
 // TestContextCancellation 测试上下文取消场景
 func TestContextCancellation(t *testing.T) {
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage())
 
 	// 创建带超时的上下文
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
@@ -325,7 +388,7 @@ func TestContextCancellation(t *testing.T) {
 	time.Sleep(150 * time.Millisecond)
 
 	// 测试认证层上下文取消
-	err := upload.uploadFile(ctx, "user123", ValidApiKey, "file001")
+	err := upload.uploadFile(ctx, "user123", ValidApiKey, "file001", strings.NewReader("hello"))
 	if err == nil {
 		t.Fatal("expected error due to context timeout, got nil")
 	}
@@ -339,13 +402,14 @@ func TestContextCancellation(t *testing.T) {
 
 // TestSuccessfulUpload 测试成功上传场景
 func TestSuccessfulUpload(t *testing.T) {
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
 
 	err := upload.uploadFile(
 		context.Background(),
 		"user123",
 		ValidApiKey,
 		"file001",
+		strings.NewReader("hello"),
 	)
 
 	if err != nil {
@@ -355,13 +419,14 @@ func TestSuccessfulUpload(t *testing.T) {
 
 // TestMetadataDeadlock 测试元数据死锁场景
 func TestMetadataDeadlock(t *testing.T) {
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage())
 
 	err := upload.uploadFile(
 		context.Background(),
 		"user123",
 		ValidApiKey,
 		DeadlockFileId,
+		strings.NewReader("hello"),
 	)
 
 	if err == nil {
@@ -387,7 +452,7 @@ func TestMetadataDeadlock(t *testing.T) {
 
 // TestErrorUnwrapping 测试错误解包支持 errors.Is 和 errors.As
 func TestErrorUnwrapping(t *testing.T) {
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage())
 
 	// 测试 errors.Is 通过错误链
 	t.Run("errors.Is through error chain", func(t *testing.T) {
@@ -396,6 +461,7 @@ func TestErrorUnwrapping(t *testing.T) {
 			TimeoutStorageUserId,
 			ValidApiKey,
 			"file001",
+			strings.NewReader("hello"),
 		)
 
 		if err == nil {
@@ -447,6 +513,7 @@ func TestErrorUnwrapping(t *testing.T) {
 					tc.userId,
 					tc.apiKey,
 					tc.fileId,
+					strings.NewReader("hello"),
 				)
 
 				if err == nil {
@@ -480,7 +547,7 @@ func TestErrorUnwrapping(t *testing.T) {
 
 // TestWithStorageOption 测试 WithStorage 选项
 func TestWithStorageOption(t *testing.T) {
-	upload := NewUploadFileService(WithAuth(), WithMeta(), WithStorage())
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
 
 	if upload.storage == nil {
 		t.Fatal("WithStorage() option should initialize storage service")
@@ -491,9 +558,2346 @@ func TestWithStorageOption(t *testing.T) {
 		"user123",
 		ValidApiKey,
 		"file001",
+		strings.NewReader("hello"),
 	)
 
 	if err != nil {
 		t.Errorf("expected no error for valid upload, got: %v", err)
 	}
 }
+
+// cancelAfterReader 读出 n 字节后取消 ctx，模拟上传途中客户端断开
+type cancelAfterReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfterReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n -= n
+	if c.n <= 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+// readStored 读取存储中用户文件的内容
+func readStored(t *testing.T, storage Storage, userId, fileId string) string {
+	t.Helper()
+	rc, err := storage.Open(context.Background(), userId, fileId)
+	if err != nil {
+		t.Fatalf("open stored file: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read stored file: %v", err)
+	}
+	return string(data)
+}
+
+func hasMetadata(upload *UploadFileService, userId, fileId string) bool {
+	_, err := upload.meta.Get(context.Background(), userId, fileId)
+	return err == nil
+}
+
+// TestStorageWritesPerUserDir 测试文件按用户保存引用并能读回内容
+func TestStorageWritesPerUserDir(t *testing.T) {
+	storage := NewStorageService(WithRoot(t.TempDir()))
+
+	if err := storage.UploadFile(context.Background(), "user123", "file001", strings.NewReader("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if data := readStored(t, storage, "user123", "file001"); data != "hello" {
+		t.Errorf("expected content %q, got %q", "hello", data)
+	}
+
+	used, err := storage.Usage("user123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 5 {
+		t.Errorf("expected usage 5, got %d", used)
+	}
+
+	// 覆盖同名文件只按新内容计费
+	if err := storage.UploadFile(context.Background(), "user123", "file001", strings.NewReader("hi")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if used, _ := storage.Usage("user123"); used != 2 {
+		t.Errorf("expected usage 2 after overwrite, got %d", used)
+	}
+
+	// 非法文件名不能逃出用户目录
+	err = storage.UploadFile(context.Background(), "user123", "../escape", strings.NewReader("x"))
+	if !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected ErrInvalidName, got %v", err)
+	}
+}
+
+// TestStorageQuotaExceeded 测试超出配额时返回 StorageQuotaError 并清理半截文件
+func TestStorageQuotaExceeded(t *testing.T) {
+	root := t.TempDir()
+	storage := NewStorageService(WithRoot(root), WithQuota(10))
+
+	if err := storage.UploadFile(context.Background(), "user123", "small", strings.NewReader("12345")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := storage.UploadFile(context.Background(), "user123", "big", strings.NewReader("123456"))
+	if err == nil {
+		t.Fatal("expected quota error, got nil")
+	}
+
+	var storageErr *StorageQuotaError
+	if !errors.As(err, &storageErr) {
+		t.Fatalf("expected StorageQuotaError, got %T", err)
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if storageErr.Temporary() {
+		t.Error("quota exceeded should not be temporary")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "refs", "user123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "small" {
+		t.Errorf("expected only the committed file to remain, got %v", entries)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(root, "tmp")); len(tmp) != 0 {
+		t.Errorf("expected partial write to be removed, got %v", tmp)
+	}
+	if used, _ := storage.Usage("user123"); used != 5 {
+		t.Errorf("expected usage 5 after rollback, got %d", used)
+	}
+
+	// 配额按用户独立计算
+	if err := storage.UploadFile(context.Background(), "user456", "big", strings.NewReader("123456")); err != nil {
+		t.Errorf("other user should have its own quota, got %v", err)
+	}
+
+	// 重启后从磁盘恢复用量
+	restarted := NewStorageService(WithRoot(root), WithQuota(10))
+	if used, _ := restarted.Usage("user123"); used != 5 {
+		t.Errorf("expected usage 5 after restart, got %d", used)
+	}
+}
+
+// TestStorageOverwriteNearQuota 测试接近配额时仍能覆盖同名文件，旧文件的大小不重复计费
+func TestStorageOverwriteNearQuota(t *testing.T) {
+	storage := NewStorageService(WithRoot(t.TempDir()), WithQuota(10))
+
+	if err := storage.UploadFile(context.Background(), "user123", "file001", strings.NewReader("12345678")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := storage.UploadFile(context.Background(), "user123", "file001", strings.NewReader("abcdefgh")); err != nil {
+		t.Fatalf("overwrite of same size should fit the quota, got %v", err)
+	}
+	if data := readStored(t, storage, "user123", "file001"); data != "abcdefgh" {
+		t.Errorf("expected content %q, got %q", "abcdefgh", data)
+	}
+	if used, _ := storage.Usage("user123"); used != 8 {
+		t.Errorf("expected usage 8 after overwrite, got %d", used)
+	}
+
+	// 旧文件只抵扣自己的大小，其他文件仍受配额限制
+	err := storage.UploadFile(context.Background(), "user123", "file001", strings.NewReader("12345678901"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	err = storage.UploadFile(context.Background(), "user123", "file002", strings.NewReader("123"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded for a new file, got %v", err)
+	}
+	if used, _ := storage.Usage("user123"); used != 8 {
+		t.Errorf("expected usage 8 after rejected uploads, got %d", used)
+	}
+}
+
+// TestStorageEmptyOverwrite 测试用量尚未加载时用空内容覆盖文件，用量不会变成负数
+func TestStorageEmptyOverwrite(t *testing.T) {
+	root := t.TempDir()
+	ctx := context.Background()
+	if err := NewStorageService(WithRoot(root)).UploadFile(ctx, "user123", "file001", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后用量尚未加载
+	storage := NewStorageService(WithRoot(root), WithQuota(10))
+	if err := storage.UploadFile(ctx, "user123", "file001", strings.NewReader("")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if used, _ := storage.Usage("user123"); used != 0 {
+		t.Errorf("expected usage 0 after empty overwrite, got %d", used)
+	}
+	if err := storage.UploadFile(ctx, "user123", "file002", strings.NewReader("0123456789")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := storage.UploadFile(ctx, "user123", "file003", strings.NewReader("0123456789"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+}
+
+// TestStorageCommitFailure 测试提交失败时只返回真正的错误，不附带重复关闭临时文件的错误
+func TestStorageCommitFailure(t *testing.T) {
+	root := t.TempDir()
+	storage := NewStorageService(WithRoot(root))
+	// 引用路径被目录占用，写入引用时失败
+	if err := os.MkdirAll(filepath.Join(root, "refs", "user123", "file001", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := storage.UploadFile(context.Background(), "user123", "file001", strings.NewReader("hello"))
+	if err == nil {
+		t.Fatal("expected commit to fail")
+	}
+	if errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected no close error joined onto the commit error, got %v", err)
+	}
+}
+
+// TestStorageCancelDuringCopy 测试拷贝途中取消 ctx 能及时停止并清理
+func TestStorageCancelDuringCopy(t *testing.T) {
+	root := t.TempDir()
+	storage := NewStorageService(WithRoot(root))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &cancelAfterReader{
+		r:      io.LimitReader(zeroReader{}, 10<<20),
+		n:      copyBufferSize,
+		cancel: cancel,
+	}
+	err := storage.UploadFile(ctx, "user123", "file001", r)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	for _, dir := range []string{filepath.Join(root, "refs", "user123"), filepath.Join(root, "tmp")} {
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("expected partial write to be removed, got %v", entries)
+		}
+	}
+	if used, _ := storage.Usage("user123"); used != 0 {
+		t.Errorf("expected usage 0 after cancel, got %d", used)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// TestSagaCompensatesMetadata 测试存储失败时回滚已保存的元数据
+func TestSagaCompensatesMetadata(t *testing.T) {
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+
+	err := upload.uploadFile(context.Background(), InvalidStorageUserId, ValidApiKey, "file001", strings.NewReader("hello"))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	var storageErr *StorageQuotaError
+	if !errors.As(err, &storageErr) {
+		t.Fatalf("expected StorageQuotaError, got %v", err)
+	}
+	if hasMetadata(upload, InvalidStorageUserId, "file001") {
+		t.Error("metadata should be removed after storage failure")
+	}
+
+	// 成功上传的元数据保留
+	if err := upload.uploadFile(context.Background(), "user123", ValidApiKey, "file001", strings.NewReader("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hasMetadata(upload, "user123", "file001") {
+		t.Error("metadata should be kept after successful upload")
+	}
+}
+
+// TestSagaCompensatesAfterCancel 测试调用方 ctx 取消后补偿仍然执行
+func TestSagaCompensatesAfterCancel(t *testing.T) {
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelAfterReader{r: strings.NewReader("hello"), n: 1, cancel: cancel}
+
+	err := upload.uploadFile(ctx, "user123", ValidApiKey, "file001", r)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if hasMetadata(upload, "user123", "file001") {
+		t.Error("metadata should be removed even though the caller's context was cancelled")
+	}
+}
+
+// TestSagaRestoresOverwrittenMetadata 测试覆盖已有文件失败时恢复原来的元数据而不是删除
+func TestSagaRestoresOverwrittenMetadata(t *testing.T) {
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+	ctx := context.Background()
+
+	if err := upload.uploadFile(ctx, "user123", ValidApiKey, "file001", strings.NewReader("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before, err := upload.meta.Get(ctx, "user123", "file001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readErr := errors.New("connection reset")
+	body := io.MultiReader(strings.NewReader("goodbye"), iotest.ErrReader(readErr))
+	if err := upload.uploadFile(ctx, "user123", ValidApiKey, "file001", body); !errors.Is(err, readErr) {
+		t.Fatalf("expected %v, got %v", readErr, err)
+	}
+
+	after, err := upload.meta.Get(ctx, "user123", "file001")
+	if err != nil {
+		t.Fatalf("metadata of the existing file should be restored, got %v", err)
+	}
+	if after.Checksum != before.Checksum || after.Size != before.Size || !after.CreatedAt.Equal(before.CreatedAt) {
+		t.Errorf("expected restored record %+v, got %+v", before, after)
+	}
+	if after.Version <= before.Version {
+		t.Errorf("restore should bump the version past %d, got %d", before.Version, after.Version)
+	}
+}
+
+// TestSagaRollbackOrder 测试补偿逆序执行且补偿错误会合并到原始错误上
+func TestSagaRollbackOrder(t *testing.T) {
+	var order []string
+	compErr := errors.New("cleanup failed")
+	cause := errors.New("step3 failed")
+
+	s := newSaga(time.Second)
+	s.add("step1", func(ctx context.Context) error {
+		order = append(order, "step1")
+		return nil
+	})
+	s.add("step2", func(ctx context.Context) error {
+		order = append(order, "step2")
+		return compErr
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.add("check-ctx", func(ctx context.Context) error {
+		order = append(order, "check-ctx")
+		return ctx.Err()
+	})
+
+	err := s.rollback(ctx, cause)
+	if got := strings.Join(order, ","); got != "check-ctx,step2,step1" {
+		t.Errorf("expected reverse order, got %s", got)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("rollback error should wrap the original cause")
+	}
+	if !errors.Is(err, compErr) {
+		t.Error("rollback error should include compensation failures")
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Error("compensations should run with a detached context")
+	}
+}
+
+// TestUploadHandlerStatusMapping 测试服务层错误到 HTTP 状态码的映射
+func TestUploadHandlerStatusMapping(t *testing.T) {
+	const secretKey = "secret-api-key-should-never-be-echoed"
+
+	testCases := []struct {
+		name   string
+		userId string
+		fileId string
+		apiKey string
+		body   string
+		status int
+	}{
+		{"success", "user123", "file001", ValidApiKey, "hello", http.StatusCreated},
+		{"invalid api key", "user123", "file001", secretKey, "hello", http.StatusUnauthorized},
+		{"forbidden user", InvalidUserId, "file001", ValidApiKey, "hello", http.StatusForbidden},
+		{"auth timeout", TimeoutUserId, "file001", ValidApiKey, "hello", http.StatusServiceUnavailable},
+		{"metadata deadlock", "user123", DeadlockFileId, ValidApiKey, "hello", http.StatusServiceUnavailable},
+		{"file too large", "user123", "file001", ValidApiKey, strings.Repeat("x", 11), http.StatusRequestEntityTooLarge},
+		{"storage failure", InvalidStorageUserId, "file001", ValidApiKey, "hello", http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir()), WithQuota(10)))
+			h := NewUploadHandler(upload, WithRetryAfter(2*time.Second))
+
+			req := httptest.NewRequest(http.MethodPut, "/users/"+tc.userId+"/files/"+tc.fileId, strings.NewReader(tc.body))
+			req.Header.Set("X-API-Key", tc.apiKey)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, rec.Code, rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), tc.apiKey) {
+				t.Errorf("response body must not echo the api key: %s", rec.Body)
+			}
+			if tc.status == http.StatusCreated {
+				return
+			}
+
+			if ct := rec.Header().Get("Content-Type"); ct != problemContentType {
+				t.Errorf("expected %s, got %q", problemContentType, ct)
+			}
+			var p Problem
+			if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+				t.Fatalf("decode problem: %v", err)
+			}
+			if p.Status != tc.status {
+				t.Errorf("expected problem status %d, got %d", tc.status, p.Status)
+			}
+			if tc.status == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") != "2" {
+				t.Errorf("expected Retry-After 2, got %q", rec.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+// TestUploadHandlerQuotaExhausted 测试已用空间耗尽时返回 507
+func TestUploadHandlerQuotaExhausted(t *testing.T) {
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir()), WithQuota(10)))
+	h := NewUploadHandler(upload)
+
+	for i, want := range []int{http.StatusCreated, http.StatusInsufficientStorage} {
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/users/user123/files/file%d", i), strings.NewReader("123456"))
+		req.Header.Set("Authorization", "Bearer "+ValidApiKey)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("upload %d: expected status %d, got %d", i, want, rec.Code)
+		}
+	}
+}
+
+// leakyAuth 是把 API key 写进错误文本的第三方认证实现
+type leakyAuth struct{}
+
+func (leakyAuth) Authenticate(ctx context.Context, userId, apiKey string) error {
+	return fmt.Errorf("no user %s with key %s", userId, apiKey)
+}
+
+// TestUploadHandlerLogRedactsKey 测试失败日志中的错误树不包含 API key，AuthError 只记录指纹
+func TestUploadHandlerLogRedactsKey(t *testing.T) {
+	const secretKey = "sk-live-do-not-log-0123456789"
+	testCases := []struct {
+		name string
+		auth Authenticator
+		want string
+	}{
+		{"leaky authenticator", leakyAuth{}, "[REDACTED]"},
+		{"auth error", NewAuthService(), Fingerprint(secretKey)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			upload := newUploadService(t, WithAuthenticator(tc.auth), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+			h := NewUploadHandler(upload, WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))))
+
+			req := httptest.NewRequest(http.MethodPut, "/users/user123/files/file001", strings.NewReader("hello"))
+			req.Header.Set("Authorization", "Bearer "+secretKey)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			out := buf.String()
+			if out == "" {
+				t.Fatal("expected the failure to be logged")
+			}
+			if strings.Contains(out, secretKey) {
+				t.Errorf("log output contains the api key: %s", out)
+			}
+			if !strings.Contains(out, tc.want) {
+				t.Errorf("log output should contain %q: %s", tc.want, out)
+			}
+		})
+	}
+}
+
+// TestUploadHandlerMultipart 测试 multipart 上传以流的方式写入存储
+func TestUploadHandlerMultipart(t *testing.T) {
+	root := t.TempDir()
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(root)))
+	h := NewUploadHandler(upload)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", "ignored")
+	fw, _ := mw.CreateFormFile("file", "hello.txt")
+	fw.Write([]byte("hello multipart"))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/users/user123/files/file001", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-API-Key", ValidApiKey)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	if data := readStored(t, upload.storage, "user123", "file001"); data != "hello multipart" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	// 缺少 file 字段
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	mw.WriteField("comment", "no file")
+	mw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/users/user123/files/file002", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for missing file part, got %d", rec.Code)
+	}
+}
+
+// TestUploadHandlerContentType 测试原始请求体与 multipart 字段的 Content-Type 写入元数据
+func TestUploadHandlerContentType(t *testing.T) {
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+	h := NewUploadHandler(upload)
+	ctx := context.Background()
+
+	req := httptest.NewRequest(http.MethodPut, "/users/user123/files/file001", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "Text/Plain; Charset=utf-8")
+	req.Header.Set("X-API-Key", ValidApiKey)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="a.json"`},
+		"Content-Type":        {"application/json"},
+	})
+	fw.Write([]byte(`{"hello":"world"}`))
+	mw.Close()
+	req = httptest.NewRequest(http.MethodPost, "/users/user123/files/file002", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-API-Key", ValidApiKey)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+
+	for fileId, want := range map[string]string{
+		"file001": "text/plain; charset=utf-8",
+		"file002": "application/json",
+	} {
+		got, err := upload.meta.Get(ctx, "user123", fileId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ContentType != want {
+			t.Errorf("%s: expected content type %q, got %q", fileId, want, got.ContentType)
+		}
+	}
+
+	// 相同幂等 key 但类型不同视为不同的请求
+	for i, ct := range []string{"text/plain", "text/html"} {
+		req = httptest.NewRequest(http.MethodPut, "/users/user123/files/file003", strings.NewReader("hello"))
+		req.Header.Set("Content-Type", ct)
+		req.Header.Set("X-API-Key", ValidApiKey)
+		req.Header.Set("Idempotency-Key", "key-1")
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if want := []int{http.StatusCreated, http.StatusUnprocessableEntity}[i]; rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", ct, want, rec.Code)
+		}
+	}
+}
+
+// tempError 用于测试被包装的 Temporary() 错误
+type tempError bool
+
+func (e tempError) Error() string   { return "temp error" }
+func (e tempError) Temporary() bool { return bool(e) }
+
+// TestKindOf 测试每条分类路径，以及多层包装后仍能取到类别
+func TestKindOf(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		kind Kind
+	}{
+		{"nil", nil, KindUnknown},
+		{"deadline", context.DeadlineExceeded, KindDeadlineExceeded},
+		{"canceled", context.Canceled, KindCanceled},
+		{"invalid api key", ErrInvalidApiKey, KindUnauthenticated},
+		{"invalid user id", ErrInvalidUserId, KindPermissionDenied},
+		{"fs permission", fs.ErrPermission, KindPermissionDenied},
+		{"quota", ErrQuotaExceeded, KindResourceExhausted},
+		{"file too large", ErrFileTooLarge, KindResourceExhausted},
+		{"invalid name", ErrInvalidName, KindInvalidArgument},
+		{"not exist", fs.ErrNotExist, KindNotFound},
+		{"exist", fs.ErrExist, KindAlreadyExists},
+		{"deadlock", &DeadlockError{}, KindAborted},
+		{"wrapped temporary", fmt.Errorf("wrap: %w", tempError(true)), KindUnavailable},
+		{"wrapped permanent", fmt.Errorf("wrap: %w", tempError(false)), KindInternal},
+		{"plain", errors.New("boom"), KindInternal},
+		{"auth error", NewAuthError("Authenticate", "u", "k", ErrInvalidApiKey), KindUnauthenticated},
+		{"metadata error", NewMetadataError("SaveMetadata", "u", "f", &DeadlockError{}), KindAborted},
+		{"storage error", NewStorageQuotaError("UploadFile", "u", "f", ErrQuotaExceeded), KindResourceExhausted},
+		{"metadata wrapping temporary", NewMetadataError("SaveMetadata", "u", "f", tempError(true)), KindUnavailable},
+		{"auth wrapping temporary", NewAuthError("Authenticate", "u", "k", tempError(true)), KindUnavailable},
+		{"three layers", fmt.Errorf("l3: %w", fmt.Errorf("l2: %w",
+			fmt.Errorf("l1: %w", NewStorageQuotaError("UploadFile", "u", "f", context.DeadlineExceeded)))), KindDeadlineExceeded},
+		{"joined", errors.Join(NewMetadataError("SaveMetadata", "u", "f", context.Canceled), errors.New("cleanup")), KindCanceled},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := KindOf(tc.err); got != tc.kind {
+				t.Errorf("expected %s, got %s", tc.kind, got)
+			}
+			if got, want := IsRetryable(tc.err), tc.kind.Retryable(); got != want {
+				t.Errorf("IsRetryable: expected %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+// TestServiceErrorsAgree 测试三种服务错误对同一原因给出相同的 Timeout/Temporary 判断
+func TestServiceErrorsAgree(t *testing.T) {
+	causes := []struct {
+		err       error
+		timeout   bool
+		temporary bool
+	}{
+		{context.DeadlineExceeded, true, true},
+		{&DeadlockError{}, false, true},
+		{tempError(true), false, true},
+		{tempError(false), false, false},
+		{context.Canceled, false, false},
+		{ErrQuotaExceeded, false, false},
+	}
+
+	for _, c := range causes {
+		errs := []interface {
+			error
+			Timeout() bool
+			Temporary() bool
+		}{
+			NewAuthError("op", "u", "k", c.err),
+			NewMetadataError("op", "u", "f", c.err),
+			NewStorageQuotaError("op", "u", "f", c.err),
+		}
+		for _, err := range errs {
+			if err.Timeout() != c.timeout {
+				t.Errorf("%T(%v).Timeout() = %v, want %v", err, c.err, err.Timeout(), c.timeout)
+			}
+			if err.Temporary() != c.temporary {
+				t.Errorf("%T(%v).Temporary() = %v, want %v", err, c.err, err.Temporary(), c.temporary)
+			}
+		}
+	}
+}
+
+func TestKindString(t *testing.T) {
+	if KindResourceExhausted.String() != "ResourceExhausted" {
+		t.Errorf("unexpected %q", KindResourceExhausted.String())
+	}
+	if Kind(200).String() != "Unknown" {
+		t.Errorf("unexpected %q", Kind(200).String())
+	}
+}
+
+// fakeClock 记录每次等待的时长并立即返回，测试重试时不需要真正睡眠
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+	block  bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	ch := make(chan time.Time, 1)
+	if !c.block {
+		c.now = c.now.Add(d)
+		ch <- c.now
+	}
+	return ch
+}
+
+// TestRetryTemporaryStep 测试临时错误重试直到成功，退避时间受上限约束
+func TestRetryTemporaryStep(t *testing.T) {
+	clock := &fakeClock{}
+	policy := RetryPolicy{MaxRetries: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond, Clock: clock}
+	rt := newRetrier(&policy)
+
+	calls := 0
+	err := rt.do(context.Background(), "flaky", func(ctx context.Context) error {
+		calls++
+		if calls < 4 {
+			return NewMetadataError("SaveMetadata", "u", "f", &DeadlockError{})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("expected 4 calls, got %d", calls)
+	}
+
+	caps := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}
+	if len(clock.sleeps) != len(caps) {
+		t.Fatalf("expected %d sleeps, got %v", len(caps), clock.sleeps)
+	}
+	for i, d := range clock.sleeps {
+		if d < 0 || d >= caps[i] {
+			t.Errorf("sleep %d = %v, want in [0, %v)", i, d, caps[i])
+		}
+	}
+
+	// 预算已用掉 3 次，只剩 2 次
+	calls = 0
+	err = rt.do(context.Background(), "always", func(ctx context.Context) error {
+		calls++
+		return NewMetadataError("SaveMetadata", "u", "f", &DeadlockError{})
+	})
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected RetryError, got %v", err)
+	}
+	if retryErr.Attempts != 3 || calls != 3 {
+		t.Errorf("expected 3 attempts with the remaining budget, got %d (calls %d)", retryErr.Attempts, calls)
+	}
+}
+
+// TestRetrySkipsPermanentErrors 测试非临时错误不重试
+func TestRetrySkipsPermanentErrors(t *testing.T) {
+	clock := &fakeClock{}
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())),
+		WithRetry(RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Clock: clock}))
+
+	err := upload.uploadFile(context.Background(), "user123", ValidApiKey, InvalidFileId, strings.NewReader("hello"))
+	var metaErr *MetadataError
+	if !errors.As(err, &metaErr) {
+		t.Fatalf("expected MetadataError, got %v", err)
+	}
+	// 没有重试过的错误原样返回，不包装为 RetryError
+	var retryErr *RetryError
+	if errors.As(err, &retryErr) || strings.Contains(err.Error(), "attempts") {
+		t.Errorf("permanent error should be returned unwrapped, got %v", err)
+	}
+	if len(clock.sleeps) != 0 {
+		t.Errorf("permanent error should not be retried, sleeps %v", clock.sleeps)
+	}
+}
+
+// TestRetryUploadFileDeadlock 测试死锁错误按预算重试，最终错误带上尝试次数且仍可提取原始错误
+func TestRetryUploadFileDeadlock(t *testing.T) {
+	clock := &fakeClock{}
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())),
+		WithRetry(RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second, Clock: clock}))
+
+	err := upload.uploadFile(context.Background(), "user123", ValidApiKey, DeadlockFileId, strings.NewReader("hello"))
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected RetryError, got %v", err)
+	}
+	if retryErr.Step != "SaveMetadata" || retryErr.Attempts != 3 {
+		t.Errorf("expected SaveMetadata after 3 attempts, got %s after %d", retryErr.Step, retryErr.Attempts)
+	}
+	var deadlock *DeadlockError
+	if !errors.As(err, &deadlock) {
+		t.Error("expected DeadlockError in error chain")
+	}
+	if len(clock.sleeps) != 2 {
+		t.Errorf("expected 2 backoff sleeps, got %v", clock.sleeps)
+	}
+}
+
+// TestRetryStopsOnCancel 测试退避等待期间取消 ctx 立即返回
+func TestRetryStopsOnCancel(t *testing.T) {
+	clock := &fakeClock{block: true}
+	rt := newRetrier(&RetryPolicy{MaxRetries: 10, BaseDelay: time.Hour, MaxDelay: time.Hour, Clock: clock})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := rt.do(ctx, "flaky", func(ctx context.Context) error {
+		return NewMetadataError("SaveMetadata", "u", "f", &DeadlockError{})
+	})
+	if time.Since(start) > time.Second {
+		t.Fatal("retry loop did not stop after cancellation")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled in error chain, got %v", err)
+	}
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 1 {
+		t.Errorf("expected RetryError with 1 attempt, got %v", err)
+	}
+}
+
+// TestRetryStorageNeedsSeeker 测试只有可 Seek 的上传内容才会在存储层重试
+func TestRetryStorageNeedsSeeker(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Clock: &fakeClock{}}
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())), WithRetry(policy))
+
+	testCases := []struct {
+		name     string
+		body     io.Reader
+		attempts int
+	}{
+		{"seekable", strings.NewReader("hello"), 3},
+		{"stream", io.MultiReader(strings.NewReader("hello")), 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := upload.uploadFile(context.Background(), TimeoutStorageUserId, ValidApiKey, "file001", tc.body)
+			var retryErr *RetryError
+			if tc.attempts == 1 {
+				if errors.As(err, &retryErr) || !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("expected the unretried storage error, got %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &retryErr) {
+				t.Fatalf("expected RetryError, got %v", err)
+			}
+			if retryErr.Step != "UploadFile" || retryErr.Attempts != tc.attempts {
+				t.Errorf("expected UploadFile after %d attempts, got %s after %d", tc.attempts, retryErr.Step, retryErr.Attempts)
+			}
+		})
+	}
+}
+
+// TestKeyStoreRotation 测试多个有效 key、过期以及轮换宽限期
+func TestKeyStoreRotation(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	keys := NewKeyStore(clock)
+
+	keys.AddKey("user123", "key-old", time.Time{})
+	if err := keys.Verify("user123", "key-old"); err != nil {
+		t.Fatalf("expected key-old to be valid, got %v", err)
+	}
+	if err := keys.Verify("user456", "key-old"); !errors.Is(err, ErrInvalidApiKey) {
+		t.Errorf("key must be bound to its user, got %v", err)
+	}
+
+	// 轮换后旧 key 在宽限期内仍然有效
+	newId := keys.Rotate("user123", "key-new", 24*time.Hour, time.Hour)
+	for _, k := range []string{"key-old", "key-new"} {
+		if err := keys.Verify("user123", k); err != nil {
+			t.Errorf("expected %s to be valid during grace period, got %v", k, err)
+		}
+	}
+
+	clock.After(time.Hour)
+	if err := keys.Verify("user123", "key-old"); !errors.Is(err, ErrInvalidApiKey) {
+		t.Errorf("expected key-old to expire after grace period, got %v", err)
+	}
+	if err := keys.Verify("user123", "key-new"); err != nil {
+		t.Errorf("expected key-new to stay valid, got %v", err)
+	}
+
+	clock.After(24 * time.Hour)
+	if err := keys.Verify("user123", "key-new"); !errors.Is(err, ErrInvalidApiKey) {
+		t.Errorf("expected key-new to expire after ttl, got %v", err)
+	}
+
+	id := keys.AddKey("user123", "key-revoked", time.Time{})
+	if err := keys.RevokeKey("user123", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Verify("user123", "key-revoked"); !errors.Is(err, ErrInvalidApiKey) {
+		t.Errorf("expected revoked key to be rejected, got %v", err)
+	}
+	if err := keys.RevokeKey("user123", newId); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expired key should have been pruned, got %v", err)
+	}
+}
+
+// TestKeyStoreStoresHashesOnly 测试 KeyStore 不保存 API key 原文
+func TestKeyStoreStoresHashesOnly(t *testing.T) {
+	const secret = "super-secret-key"
+	keys := NewKeyStore(nil)
+	keys.AddKey("user123", secret, time.Time{})
+	keys.AddKey("user123", secret, time.Time{})
+
+	stored := keys.keys["user123"]
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(stored))
+	}
+	if bytes.Equal(stored[0].salt, stored[1].salt) || stored[0].hash == stored[1].hash {
+		t.Error("each key should use its own salt")
+	}
+	if bytes.Contains(stored[0].hash[:], []byte(secret)) {
+		t.Error("stored hash must not contain the raw key")
+	}
+
+	// 指纹是带密钥的 HMAC：同一个 store 内稳定，不同 store 之间不同，也不是 key 的普通哈希
+	fp := keys.Fingerprint(secret)
+	if fp != keys.Fingerprint(secret) {
+		t.Error("fingerprint should be stable within a store")
+	}
+	if fp == NewKeyStore(nil).Fingerprint(secret) {
+		t.Error("fingerprint should depend on the store's secret")
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if strings.Contains(fp, hex.EncodeToString(sum[:6])) {
+		t.Errorf("fingerprint %q is an unkeyed hash of the key", fp)
+	}
+}
+
+// TestAuthErrorLogValue 测试通过 slog 记录 AuthError 时只输出指纹
+func TestAuthErrorLogValue(t *testing.T) {
+	const secret = "secret-api-key-xyz-12345"
+	keys := NewKeyStore(nil)
+	keys.AddKey("user123", "another-key", time.Time{})
+	upload := newUploadService(t, WithAuth(WithKeyStore(keys)), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+
+	err := upload.uploadFile(context.Background(), "user123", secret, "file001", strings.NewReader("hello"))
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected AuthError, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Error("upload file failed", slog.Any("err", authErr))
+
+	out := buf.String()
+	if strings.Contains(out, secret) {
+		t.Errorf("log output contains the api key: %s", out)
+	}
+	if !strings.Contains(out, keys.Fingerprint(secret)) {
+		t.Errorf("log output should contain the key fingerprint: %s", out)
+	}
+	if !strings.Contains(out, `"kind":"Unauthenticated"`) {
+		t.Errorf("log output should contain the error kind: %s", out)
+	}
+
+	if err := upload.uploadFile(context.Background(), "user123", "another-key", "file001", strings.NewReader("hello")); err != nil {
+		t.Errorf("expected key from the store to be accepted, got %v", err)
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// TestResumableUpload 测试分片上传：断点续传、分片校验、整体校验后提交
+func TestResumableUpload(t *testing.T) {
+	root := t.TempDir()
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(root)),
+		WithSessions(WithSessionDir(t.TempDir())))
+	ctx := context.Background()
+
+	chunks := []string{"hello ", "resumable ", "world"}
+	full := strings.Join(chunks, "")
+
+	st, err := upload.CreateSession(ctx, "user123", ValidApiKey, "file001", len(chunks), sha256Hex(full))
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	for _, i := range []int{0, 2} {
+		if err := upload.UploadChunk(ctx, st.Id, ValidApiKey, i, sha256Hex(chunks[i]), strings.NewReader(chunks[i])); err != nil {
+			t.Fatalf("upload chunk %d: %v", i, err)
+		}
+	}
+
+	st, err = upload.SessionStatus(ctx, st.Id, ValidApiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(st.Received) != "[0 2]" || fmt.Sprint(st.Missing) != "[1]" {
+		t.Errorf("unexpected status received=%v missing=%v", st.Received, st.Missing)
+	}
+
+	err = upload.FinalizeSession(ctx, st.Id, ValidApiKey)
+	if !errors.Is(err, ErrSessionIncomplete) || KindOf(err) != KindFailedPrecondition {
+		t.Errorf("expected ErrSessionIncomplete, got %v", err)
+	}
+
+	// 传输中损坏的分片被拒绝，之后可以重传
+	err = upload.UploadChunk(ctx, st.Id, ValidApiKey, 1, sha256Hex(chunks[1]), strings.NewReader("corrupted"))
+	var sessErr *SessionError
+	if !errors.As(err, &sessErr) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected SessionError with ErrChecksumMismatch, got %v", err)
+	}
+	if err := upload.UploadChunk(ctx, st.Id, ValidApiKey, 1, sha256Hex(chunks[1]), strings.NewReader(chunks[1])); err != nil {
+		t.Fatalf("re-upload chunk: %v", err)
+	}
+
+	if err := upload.FinalizeSession(ctx, st.Id, ValidApiKey); err != nil {
+		t.Fatalf("finalize: %v", err)
+	}
+
+	if data := readStored(t, upload.storage, "user123", "file001"); data != full {
+		t.Errorf("expected %q, got %q", full, data)
+	}
+	if !hasMetadata(upload, "user123", "file001") {
+		t.Error("metadata should be committed on finalize")
+	}
+
+	if _, err := upload.SessionStatus(ctx, st.Id, ValidApiKey); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("session should be removed after finalize, got %v", err)
+	}
+}
+
+// TestResumableUploadChecksumMismatch 测试整体 checksum 不一致时不提交
+func TestResumableUploadChecksumMismatch(t *testing.T) {
+	root := t.TempDir()
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(root)),
+		WithSessions(WithSessionDir(t.TempDir()), WithMaxChunkSize(4)))
+	ctx := context.Background()
+
+	st, err := upload.CreateSession(ctx, "user123", ValidApiKey, "file001", 1, sha256Hex("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = upload.UploadChunk(ctx, st.Id, ValidApiKey, 0, sha256Hex("hello"), strings.NewReader("hello"))
+	if !errors.Is(err, ErrChunkTooLarge) {
+		t.Errorf("expected ErrChunkTooLarge, got %v", err)
+	}
+	if err := upload.UploadChunk(ctx, st.Id, ValidApiKey, 0, sha256Hex("hell"), strings.NewReader("hell")); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.UploadChunk(ctx, st.Id, ValidApiKey, 1, sha256Hex("o"), strings.NewReader("o")); !errors.Is(err, ErrChunkOutOfRange) {
+		t.Errorf("expected ErrChunkOutOfRange, got %v", err)
+	}
+
+	err = upload.FinalizeSession(ctx, st.Id, ValidApiKey)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, err := upload.storage.Stat(ctx, "user123", "file001"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("file must not be committed when the checksum does not match")
+	}
+	if hasMetadata(upload, "user123", "file001") {
+		t.Error("metadata must not be committed when the checksum does not match")
+	}
+
+	if _, err := upload.SessionStatus(ctx, st.Id, "wrong-key"); KindOf(err) != KindUnauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+}
+
+// TestSessionGC 测试过期会话与残留目录被回收
+func TestSessionGC(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{now: time.Now()}
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())),
+		WithSessions(WithSessionDir(dir), WithSessionTTL(time.Hour), WithSessionClock(clock)))
+	ctx := context.Background()
+
+	stale, err := upload.CreateSession(ctx, "user123", ValidApiKey, "file001", 2, sha256Hex("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.UploadChunk(ctx, stale.Id, ValidApiKey, 0, sha256Hex("x"), strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(dir, "orphan-session")
+	if err := os.MkdirAll(orphan, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.After(30 * time.Minute)
+	fresh, err := upload.CreateSession(ctx, "user123", ValidApiKey, "file002", 1, sha256Hex("y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.After(45 * time.Minute)
+	n, err := upload.CollectExpiredSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 expired session, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stale.Id)); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("expired session data should be removed")
+	}
+	if _, err := os.Stat(orphan); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("orphaned session directory should be removed")
+	}
+	if _, err := upload.SessionStatus(ctx, fresh.Id, ValidApiKey); err != nil {
+		t.Errorf("fresh session should survive, got %v", err)
+	}
+	if _, err := upload.SessionStatus(ctx, stale.Id, ValidApiKey); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+// TestSessionLimits 测试每个用户的会话数和暂存分片字节数受限，完成或回收会话后额度归还
+func TestSessionLimits(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())),
+		WithSessions(WithSessionDir(t.TempDir()), WithSessionTTL(time.Hour), WithSessionClock(clock),
+			WithMaxUserSessions(2), WithMaxStagedBytes(8)))
+	ctx := context.Background()
+
+	a, err := upload.CreateSession(ctx, "user123", ValidApiKey, "file001", 2, sha256Hex("hellowor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := upload.CreateSession(ctx, "user123", ValidApiKey, "file002", 1, sha256Hex("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = upload.CreateSession(ctx, "user123", ValidApiKey, "file003", 1, sha256Hex("x"))
+	if !errors.Is(err, ErrTooManySessions) || KindOf(err) != KindResourceExhausted {
+		t.Errorf("expected ErrTooManySessions, got %v", err)
+	}
+	if _, err := upload.CreateSession(ctx, "user456", ValidApiKey, "file001", 1, sha256Hex("x")); err != nil {
+		t.Errorf("other users have their own session limit, got %v", err)
+	}
+
+	if err := upload.UploadChunk(ctx, a.Id, ValidApiKey, 0, sha256Hex("hello"), strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// 两个会话共用 8 字节的暂存额度
+	err = upload.UploadChunk(ctx, b.Id, ValidApiKey, 0, sha256Hex("abcd"), strings.NewReader("abcd"))
+	if !errors.Is(err, ErrStagingExceeded) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrStagingExceeded, got %v", err)
+	}
+	// 覆盖同号分片只计入新旧大小之差
+	if err := upload.UploadChunk(ctx, a.Id, ValidApiKey, 0, sha256Hex("hel"), strings.NewReader("hel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.UploadChunk(ctx, b.Id, ValidApiKey, 0, sha256Hex("abc"), strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	err = upload.UploadChunk(ctx, a.Id, ValidApiKey, 1, sha256Hex("lowor"), strings.NewReader("lowor"))
+	if !errors.Is(err, ErrStagingExceeded) {
+		t.Errorf("expected ErrStagingExceeded, got %v", err)
+	}
+
+	// 完成的会话归还额度
+	if err := upload.FinalizeSession(ctx, b.Id, ValidApiKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.UploadChunk(ctx, a.Id, ValidApiKey, 1, sha256Hex("lowor"), strings.NewReader("lowor")); err != nil {
+		t.Fatalf("staged bytes should be released after finalize, got %v", err)
+	}
+
+	// 过期回收的会话同样归还额度和会话数
+	clock.After(2 * time.Hour)
+	if _, err := upload.CollectExpiredSessions(); err != nil {
+		t.Fatal(err)
+	}
+	for _, fileId := range []string{"file004", "file005"} {
+		sess, err := upload.CreateSession(ctx, "user123", ValidApiKey, fileId, 1, sha256Hex("abcd"))
+		if err != nil {
+			t.Fatalf("sessions should be released after GC, got %v", err)
+		}
+		if err := upload.UploadChunk(ctx, sess.Id, ValidApiKey, 0, sha256Hex("abcd"), strings.NewReader("abcd")); err != nil {
+			t.Fatalf("staged bytes should be released after GC, got %v", err)
+		}
+	}
+}
+
+// hookAuth 接受所有请求，并在认证时调用 hook，用于在查找会话与登记写入之间插入操作
+type hookAuth struct {
+	hook func()
+}
+
+func (a *hookAuth) Authenticate(ctx context.Context, userId, apiKey string) error {
+	if a.hook != nil {
+		a.hook()
+	}
+	return nil
+}
+
+// TestSessionGCDuringChunkAuth 测试认证期间会话被 GC 删除时，分片写入与合并返回 ErrSessionNotFound
+func TestSessionGCDuringChunkAuth(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{now: time.Now()}
+	auth := &hookAuth{}
+	upload := newUploadService(t, WithAuthenticator(auth), WithMeta(), WithStorage(WithRoot(t.TempDir())),
+		WithSessions(WithSessionDir(dir), WithSessionTTL(time.Hour), WithSessionClock(clock)))
+	ctx := context.Background()
+
+	for _, op := range []string{"UploadChunk", "FinalizeSession"} {
+		t.Run(op, func(t *testing.T) {
+			auth.hook = nil
+			sess, err := upload.CreateSession(ctx, "user123", ValidApiKey, "file001", 1, sha256Hex("x"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if op == "FinalizeSession" {
+				if err := upload.UploadChunk(ctx, sess.Id, ValidApiKey, 0, sha256Hex("x"), strings.NewReader("x")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			auth.hook = func() {
+				clock.After(2 * time.Hour)
+				if n, err := upload.CollectExpiredSessions(); n != 1 || err != nil {
+					t.Errorf("expected GC to remove the session, got %d, %v", n, err)
+				}
+			}
+			if op == "UploadChunk" {
+				err = upload.UploadChunk(ctx, sess.Id, ValidApiKey, 0, sha256Hex("x"), strings.NewReader("x"))
+			} else {
+				err = upload.FinalizeSession(ctx, sess.Id, ValidApiKey)
+			}
+			if !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("expected ErrSessionNotFound, got %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, sess.Id)); !errors.Is(err, fs.ErrNotExist) {
+				t.Error("collected session directory should not be recreated")
+			}
+		})
+	}
+}
+
+// TestMetadataStorePersistence 测试文件存储的增删查以及重启后数据仍在
+func TestMetadataStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	meta := NewMetadataService(WithMetadataDir(dir))
+
+	rec, err := meta.Put(ctx, FileRecord{UserId: "user123", FileId: "b.txt", Size: 5, Checksum: sha256Hex("hello"), ContentType: "text/plain"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Version != 1 || rec.Owner != "user123" || rec.CreatedAt.IsZero() {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if err := meta.SaveMetadata(ctx, "user123", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.SaveMetadata(ctx, "user456", "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewMetadataService(WithMetadataDir(dir))
+	got, err := reopened.Get(ctx, "user123", "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Size != 5 || got.ContentType != "text/plain" || got.Version != 1 {
+		t.Errorf("unexpected record after reopen %+v", got)
+	}
+
+	recs, err := reopened.List(ctx, "user123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].FileId != "a.txt" || recs[1].FileId != "b.txt" {
+		t.Errorf("unexpected list %+v", recs)
+	}
+
+	if err := reopened.Delete(ctx, "user123", "b.txt", 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = reopened.Get(ctx, "user123", "b.txt")
+	var metaErr *MetadataError
+	if !errors.As(err, &metaErr) || !errors.Is(err, ErrMetadataNotFound) || KindOf(err) != KindNotFound {
+		t.Errorf("expected NotFound MetadataError, got %v", err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "user123"))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("temporary file left behind: %s", e.Name())
+		}
+	}
+}
+
+// TestMetadataVersionConflict 测试版本不匹配时返回可重试的冲突错误
+func TestMetadataVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	meta := NewMetadataService(WithMetadataDir(t.TempDir()))
+
+	rec, err := meta.Put(ctx, FileRecord{UserId: "user123", FileId: "file001", Size: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个写者都基于版本 1 修改，第二个失败
+	rec.Size = 2
+	if _, err := meta.Put(ctx, rec, rec.Version); err != nil {
+		t.Fatal(err)
+	}
+	rec.Size = 3
+	_, err = meta.Put(ctx, rec, rec.Version)
+
+	var conflict *VersionConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected VersionConflictError, got %v", err)
+	}
+	if conflict.Expected != 1 || conflict.Actual != 2 {
+		t.Errorf("unexpected conflict %+v", conflict)
+	}
+	var metaErr *MetadataError
+	if !errors.As(err, &metaErr) || !metaErr.Temporary() || metaErr.Timeout() {
+		t.Errorf("conflict should be a temporary MetadataError, got %v", err)
+	}
+	if KindOf(err) != KindAborted || !IsRetryable(err) {
+		t.Errorf("expected retryable Aborted kind, got %s", KindOf(err))
+	}
+
+	// 创建已存在的记录同样冲突
+	if _, err := meta.Put(ctx, FileRecord{UserId: "user123", FileId: "file001"}, 0); !errors.As(err, &conflict) {
+		t.Errorf("expected conflict when creating an existing record, got %v", err)
+	}
+	if err := meta.Delete(ctx, "user123", "file001", 1); !errors.As(err, &conflict) {
+		t.Errorf("expected conflict when deleting a stale version, got %v", err)
+	}
+
+	got, _ := meta.Get(ctx, "user123", "file001")
+	if got.Size != 2 || got.Version != 2 {
+		t.Errorf("losing write must not be applied, got %+v", got)
+	}
+}
+
+// TestMetadataConcurrentUpdates 测试并发 CAS 更新不会丢失写入
+func TestMetadataConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	meta := NewMetadataService(WithMetadataDir(t.TempDir()))
+	if _, err := meta.Put(ctx, FileRecord{UserId: "user123", FileId: "counter"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 5 {
+				for {
+					rec, err := meta.Get(ctx, "user123", "counter")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					rec.Size++
+					_, err = meta.Put(ctx, rec, rec.Version)
+					if err == nil {
+						break
+					}
+					if !IsRetryable(err) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	rec, _ := meta.Get(ctx, "user123", "counter")
+	if rec.Size != 40 || rec.Version != 41 {
+		t.Errorf("expected size 40 version 41, got %+v", rec)
+	}
+}
+
+// TestStorageDeduplication 测试相同内容只存一份，配额按引用计费，无引用后被回收
+func TestStorageDeduplication(t *testing.T) {
+	root := t.TempDir()
+	ctx := context.Background()
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(root)))
+	storage := upload.storage.(*StorageService)
+
+	const content = "same bytes uploaded again and again"
+	digest := sha256Hex(content)
+	for _, u := range []struct{ user, file string }{{"user123", "a"}, {"user123", "b"}, {"user456", "a"}} {
+		if err := upload.uploadFile(ctx, u.user, ValidApiKey, u.file, strings.NewReader(content)); err != nil {
+			t.Fatalf("upload %s/%s: %v", u.user, u.file, err)
+		}
+	}
+
+	blobs, _ := filepath.Glob(filepath.Join(root, "blobs", "*", "*"))
+	if len(blobs) != 1 || filepath.Base(blobs[0]) != digest {
+		t.Fatalf("expected a single blob named by its digest, got %v", blobs)
+	}
+	if n, _ := storage.RefCount(digest); n != 3 {
+		t.Errorf("expected 3 references, got %d", n)
+	}
+	if used, _ := storage.Usage("user123"); used != int64(2*len(content)) {
+		t.Errorf("quota should be charged per reference, got %d", used)
+	}
+
+	rec, err := upload.meta.Get(ctx, "user456", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Checksum != digest || rec.Size != int64(len(content)) {
+		t.Errorf("metadata should reference the blob, got %+v", rec)
+	}
+
+	// 还有引用时不回收
+	if err := storage.DeleteFile(ctx, "user123", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteFile(ctx, "user123", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := storage.CollectGarbage(ctx); n != 0 {
+		t.Errorf("referenced blob must not be collected, removed %d", n)
+	}
+	if data := readStored(t, storage, "user456", "a"); data != content {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	if err := storage.DeleteFile(ctx, "user456", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := storage.CollectGarbage(ctx); err != nil || n != 1 {
+		t.Errorf("expected unreferenced blob to be collected, removed %d err %v", n, err)
+	}
+	if blobs, _ := filepath.Glob(filepath.Join(root, "blobs", "*", "*")); len(blobs) != 0 {
+		t.Errorf("expected no blobs left, got %v", blobs)
+	}
+
+	// 重启后从引用恢复引用计数
+	if err := storage.UploadFile(ctx, "user123", "c", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewStorageService(WithRoot(root))
+	if n, _ := restarted.RefCount(digest); n != 1 {
+		t.Errorf("expected refcount 1 after restart, got %d", n)
+	}
+}
+
+// TestStorageGCDuringUploads 测试上传进行中运行垃圾回收不会删掉刚写入的内容
+func TestStorageGCDuringUploads(t *testing.T) {
+	ctx := context.Background()
+	storage := NewStorageService(WithRoot(t.TempDir()))
+
+	stop := make(chan struct{})
+	gcDone := make(chan struct{})
+	go func() {
+		defer close(gcDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				storage.CollectGarbage(ctx)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for j := range 10 {
+				fileId := fmt.Sprintf("file-%d-%d", i, j)
+				content := fmt.Sprintf("content-%d", j%3)
+				if err := storage.UploadFile(ctx, "user123", fileId, strings.NewReader(content)); err != nil {
+					t.Error(err)
+					return
+				}
+				if j%2 == 0 {
+					if err := storage.DeleteFile(ctx, "user123", fileId); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(stop)
+	<-gcDone
+
+	for i := range 8 {
+		for j := 1; j < 10; j += 2 {
+			if data := readStored(t, storage, "user123", fmt.Sprintf("file-%d-%d", i, j)); data != fmt.Sprintf("content-%d", j%3) {
+				t.Errorf("unexpected content %q", data)
+			}
+		}
+	}
+}
+
+// TestIdempotentUploadReplay 测试相同 key 重放第一次的结果，内容不同时冲突，过期后重新执行
+func TestIdempotentUploadReplay(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{}
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())),
+		WithIdempotency(WithIdempotencyWindow(time.Hour), WithIdempotencyClock(clock)))
+
+	for range 3 {
+		if err := upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, "file123", strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec, err := upload.meta.Get(ctx, "user123", "file123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Version != 2 {
+		t.Errorf("expected a single upload (version 2), got version %d", rec.Version)
+	}
+
+	err = upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, "file123", strings.NewReader("other"))
+	if !errors.Is(err, ErrIdempotencyConflict) {
+		t.Fatalf("expected ErrIdempotencyConflict, got %v", err)
+	}
+	if KindOf(err) != KindFailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", KindOf(err))
+	}
+
+	// 重放也要认证
+	err = upload.uploadFileIdempotent(ctx, "key-1", "user123", "wrong_key", "file123", strings.NewReader("hello"))
+	if !errors.Is(err, ErrInvalidApiKey) {
+		t.Errorf("expected ErrInvalidApiKey, got %v", err)
+	}
+
+	// 过期后同一个 key 会重新执行
+	clock.After(time.Hour)
+	if err := upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, "file123", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	if data := readStored(t, upload.storage, "user123", "file123"); data != "other" {
+		t.Errorf("expected new content after expiry, got %q", data)
+	}
+}
+
+// TestIdempotentUploadWrongKeyFirst 测试凭据错误的第一次请求不会占用幂等 key
+func TestIdempotentUploadWrongKeyFirst(t *testing.T) {
+	ctx := context.Background()
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+
+	err := upload.uploadFileIdempotent(ctx, "key-1", "user123", "wrong_key", "file123", strings.NewReader("hello"))
+	if KindOf(err) != KindUnauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+	if err := upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, "file123", strings.NewReader("hello")); err != nil {
+		t.Fatalf("expected the key to still be usable, got %v", err)
+	}
+	if data := readStored(t, upload.storage, "user123", "file123"); data != "hello" {
+		t.Errorf("expected stored content %q, got %q", "hello", data)
+	}
+
+	// 即使认证在流水线中途失败，结果也不会被保存
+	e, _ := upload.idempotency.begin("user123", "key-2")
+	upload.idempotency.finish("user123", "key-2", e, "fingerprint", NewAuthError("Authenticate", "user123", "k", ErrInvalidApiKey))
+	if _, leader := upload.idempotency.begin("user123", "key-2"); !leader {
+		t.Error("authentication failures should not be cached")
+	}
+}
+
+// TestIdempotentUploadCachesFailures 测试永久失败会被重放，可重试的失败不会被记住
+func TestIdempotentUploadCachesFailures(t *testing.T) {
+	ctx := context.Background()
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+
+	first := upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, InvalidFileId, strings.NewReader("hello"))
+	if first == nil {
+		t.Fatal("expected error")
+	}
+	replay := upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, InvalidFileId, strings.NewReader("hello"))
+	if replay != first {
+		t.Errorf("expected the original error to be replayed, got %v", replay)
+	}
+
+	if err := upload.uploadFileIdempotent(ctx, "key-2", "user123", ValidApiKey, DeadlockFileId, strings.NewReader("hello")); !IsRetryable(err) {
+		t.Fatalf("expected retryable error, got %v", err)
+	}
+	if err := upload.uploadFileIdempotent(ctx, "key-2", "user123", ValidApiKey, "file123", strings.NewReader("hello")); err != nil {
+		t.Errorf("expected retry with the same key to run again, got %v", err)
+	}
+}
+
+// endlessReader 不支持 Seek，返回无穷的内容并记录被读取的字节数
+type endlessReader struct {
+	n atomic.Int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// failingSeeker 可以读取但 Seek 总是失败
+type failingSeeker struct {
+	*strings.Reader
+}
+
+func (failingSeeker) Seek(int64, int) (int64, error) {
+	return 0, errors.New("seek failed")
+}
+
+// TestIdempotentUploadNoFingerprint 测试拿不到完整摘要时不读完剩余内容，结果也不保存
+func TestIdempotentUploadNoFingerprint(t *testing.T) {
+	ctx := context.Background()
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+
+	body := &endlessReader{}
+	if err := upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, InvalidFileId, body); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := body.n.Load(); n != 0 {
+		t.Errorf("the body should not be drained after a failure, read %d bytes", n)
+	}
+	if _, leader := upload.idempotency.begin("user123", "key-1"); !leader {
+		t.Error("a result without a fingerprint should not be stored")
+	}
+
+	err := upload.uploadFileIdempotent(ctx, "key-2", "user123", ValidApiKey, "file123", failingSeeker{strings.NewReader("hello")})
+	if err == nil {
+		t.Fatal("expected the seek error")
+	}
+	if _, leader := upload.idempotency.begin("user123", "key-2"); !leader {
+		t.Error("a failed fingerprint should not be stored")
+	}
+
+	// 等待中的重复请求无法比对结果时返回可重试的错误
+	e, _ := upload.idempotency.begin("user123", "key-3")
+	upload.idempotency.finish("user123", "key-3", e, "", errors.New("boom"))
+	err = upload.awaitIdempotent(ctx, e, "key-3", &UploadRecord{UserId: "user123", FileId: "file123", Body: strings.NewReader("hello")})
+	if !errors.Is(err, ErrIdempotencyAborted) || !IsRetryable(err) {
+		t.Errorf("expected retryable ErrIdempotencyAborted, got %v", err)
+	}
+}
+
+// countingAuth 记录认证次数
+type countingAuth struct {
+	Authenticator
+	n atomic.Int32
+}
+
+func (a *countingAuth) Authenticate(ctx context.Context, userId, apiKey string) error {
+	a.n.Add(1)
+	return a.Authenticator.Authenticate(ctx, userId, apiKey)
+}
+
+// TestIdempotentUploadAuthOnce 测试幂等请求只认证一次，认证失败同样写入审计日志
+func TestIdempotentUploadAuthOnce(t *testing.T) {
+	ctx := context.Background()
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	auth := &countingAuth{Authenticator: NewAuthService()}
+	upload := newUploadService(t, WithAuthenticator(auth), WithMeta(), WithStorage(WithRoot(t.TempDir())), WithAudit(audit))
+
+	if err := upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, "file123", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := auth.n.Load(); n != 1 {
+		t.Errorf("expected a single authentication, got %d", n)
+	}
+	if head := audit.Head(); head.Seq != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", head.Seq)
+	}
+
+	if err := upload.uploadFileIdempotent(ctx, "key-2", "user123", "wrong_key", "file123", strings.NewReader("hello")); KindOf(err) != KindUnauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+	if head := audit.Head(); head.Seq != 2 {
+		t.Errorf("the failed authentication should be audited, got %d entries", head.Seq)
+	}
+}
+
+// TestIdempotentUploadConcurrent 测试第一次请求进行中到达的重复请求等待并共享其结果
+func TestIdempotentUploadConcurrent(t *testing.T) {
+	ctx := context.Background()
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+
+	pr, pw := io.Pipe()
+	leaderDone := make(chan error, 1)
+	go func() {
+		leaderDone <- upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, "file123", pr)
+	}()
+	// 写入成功说明第一次请求已经登记 key 并开始读取内容
+	if _, err := pw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Go(func() {
+			errs[i] = upload.uploadFileIdempotent(ctx, "key-1", "user123", ValidApiKey, "file123", strings.NewReader("hello"))
+		})
+	}
+	pw.Close()
+	wg.Wait()
+
+	if err := <-leaderDone; err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("expected duplicate to share the result, got %v", err)
+		}
+	}
+	rec, err := upload.meta.Get(ctx, "user123", "file123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Version != 2 {
+		t.Errorf("expected a single upload (version 2), got version %d", rec.Version)
+	}
+}
+
+// TestUploadHandlerIdempotencyKey 测试 Idempotency-Key 冲突映射为 422
+func TestUploadHandlerIdempotencyKey(t *testing.T) {
+	upload := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+	h := NewUploadHandler(upload, WithLogger(slog.New(slog.DiscardHandler)))
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{"hello", http.StatusCreated},
+		{"hello", http.StatusCreated},
+		{"other", http.StatusUnprocessableEntity},
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/users/user123/files/file123", strings.NewReader(tc.body))
+		req.Header.Set("X-API-Key", ValidApiKey)
+		req.Header.Set("Idempotency-Key", "key-1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("body %q: expected %d, got %d", tc.body, tc.status, rec.Code)
+		}
+	}
+}
+
+// TestFaultInjectorRules 测试规则的匹配模式、次数限制、延迟与概率
+func TestFaultInjectorRules(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{}
+	faults, err := NewFaultInjector([]FaultRule{
+		{Op: "storage.*", UserId: "flaky-*", Error: "unavailable", Count: 2},
+		{Op: "metadata.Get", Latency: 50 * time.Millisecond},
+		{Op: "auth.Authenticate", Err: errors.New("custom"), Probability: 0.5},
+	}, WithFaultClock(clock), WithFaultSeed(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := NewFaultyStorage(NewStorageService(WithRoot(t.TempDir())), faults)
+	for i := range 3 {
+		_, err := storage.ReplaceFile(ctx, "flaky-user", "file001", strings.NewReader("hello"))
+		if wantErr := i < 2; (err != nil) != wantErr {
+			t.Errorf("attempt %d: unexpected error %v", i, err)
+		}
+		if i < 2 && !IsRetryable(err) {
+			t.Errorf("attempt %d: expected retryable error, got %v", i, err)
+		}
+	}
+	if _, err := storage.ReplaceFile(ctx, "user123", "file001", strings.NewReader("hello")); err != nil {
+		t.Errorf("unmatched user should not fail: %v", err)
+	}
+
+	meta := NewFaultyMetadata(NewMetadataService(), faults)
+	meta.Get(ctx, "user123", "file001")
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != 50*time.Millisecond {
+		t.Errorf("expected one 50ms delay, got %v", clock.sleeps)
+	}
+
+	auth := NewFaultyAuth(NewAuthService(), faults)
+	failures := 0
+	for range 200 {
+		if err := auth.Authenticate(ctx, "user123", ValidApiKey); err != nil {
+			failures++
+		}
+	}
+	if failures != faults.Fired(2) || failures < 60 || failures > 140 {
+		t.Errorf("expected about half of 200 calls to fail, got %d (fired %d)", failures, faults.Fired(2))
+	}
+}
+
+// TestFaultInjectorLatencyCancel 测试注入延迟期间取消 ctx 立即返回
+func TestFaultInjectorLatencyCancel(t *testing.T) {
+	faults, err := NewFaultInjector([]FaultRule{{Op: "auth.Authenticate", Latency: time.Hour}},
+		WithFaultClock(&fakeClock{block: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = NewFaultyAuth(NewAuthService(), faults).Authenticate(ctx, "user123", ValidApiKey)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+}
+
+// TestLoadFaultRules 测试从 JSON 文件加载规则，以及无效规则被拒绝
+func TestLoadFaultRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faults.json")
+	data := `[
+		{"op": "metadata.SaveMetadata", "fileId": "slow-*", "latency": "150ms"},
+		{"op": "storage.UploadFile", "error": "quota_exceeded", "probability": 0.25, "count": 3}
+	]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := LoadFaultRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FaultRule{
+		{Op: "metadata.SaveMetadata", FileId: "slow-*", Latency: 150 * time.Millisecond},
+		{Op: "storage.UploadFile", Error: "quota_exceeded", Probability: 0.25, Count: 3},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("expected %d rules, got %d", len(want), len(rules))
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d: expected %+v, got %+v", i, want[i], rules[i])
+		}
+	}
+	if _, err := NewFaultInjector(rules); err != nil {
+		t.Errorf("expected valid rules, got %v", err)
+	}
+
+	for _, rule := range []FaultRule{
+		{Error: "no_such_error"},
+		{UserId: "["},
+		{Probability: 1.5},
+		{Count: -1},
+	} {
+		if _, err := NewFaultInjector([]FaultRule{rule}); err == nil {
+			t.Errorf("expected rule %+v to be rejected", rule)
+		}
+	}
+}
+
+// TestWithFaultsOrder 测试 WithFaults 与服务选项的先后顺序无关，默认不注入故障，也不修改注入的服务
+func TestWithFaultsOrder(t *testing.T) {
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+	err := upload.uploadFile(context.Background(), TimeoutUserId, ValidApiKey, "file001", strings.NewReader("hello"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+
+	plain := newUploadService(t, WithAuth(), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+	if err := plain.uploadFile(context.Background(), TimeoutUserId, ValidApiKey, DeadlockFileId, strings.NewReader("hello")); err != nil {
+		t.Errorf("special ids should not fail without fault injection: %v", err)
+	}
+
+	// 注入的服务被包装而不是被修改，在服务之外直接使用时不注入故障
+	meta, storage := NewMetadataService(), NewStorageService(WithRoot(t.TempDir()))
+	newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMetadataService(meta), WithStorageService(storage))
+	if err := meta.SaveMetadata(context.Background(), "user123", DeadlockFileId); err != nil {
+		t.Errorf("injected metadata service should be left untouched: %v", err)
+	}
+	if err := storage.UploadFile(context.Background(), TimeoutStorageUserId, "file001", strings.NewReader("hello")); err != nil {
+		t.Errorf("injected storage service should be left untouched: %v", err)
+	}
+}
+
+// TestAuditLogRecordsUploads 测试每次上传记录到达的步骤与错误类别，重新打开后链继续延伸
+func TestAuditLogRecordsUploads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := newUploadService(t, WithFaults(scenarioFaults(t)), WithAuth(), WithMeta(),
+		WithStorage(WithRoot(t.TempDir())), WithAudit(audit))
+
+	ctx := context.Background()
+	upload.uploadFile(ctx, "user123", ValidApiKey, "file001", strings.NewReader("hello"))
+	upload.uploadFile(ctx, "user123", "wrong_key", "file002", strings.NewReader("hello"))
+	upload.uploadFile(ctx, "user123", ValidApiKey, DeadlockFileId, strings.NewReader("hello"))
+	upload.uploadFile(ctx, TimeoutStorageUserId, ValidApiKey, "file003", strings.NewReader("hello"))
+	head := audit.Head()
+	audit.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ step, outcome, kind string }{
+		{"UpdateMetadata", AuditSucceeded, ""},
+		{"Authenticate", AuditFailed, "Unauthenticated"},
+		{"SaveMetadata", AuditFailed, "Aborted"},
+		{"UploadFile", AuditFailed, "DeadlineExceeded"},
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(lines))
+	}
+	for i, line := range lines {
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Step != want[i].step || e.Outcome != want[i].outcome || e.Kind != want[i].kind {
+			t.Errorf("entry %d: expected %v, got step=%s outcome=%s kind=%s", i, want[i], e.Step, e.Outcome, e.Kind)
+		}
+		if strings.Contains(line, ValidApiKey) || strings.Contains(line, "wrong_key") {
+			t.Errorf("entry %d leaks the api key: %s", i, line)
+		}
+	}
+
+	if _, err := VerifyAuditLog(bytes.NewReader(data), head); err != nil {
+		t.Errorf("expected intact log, got %v", err)
+	}
+
+	reopened, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	e, err := reopened.Append(AuditEntry{UserId: "user123", FileId: "file004", Step: "Authenticate", Outcome: AuditSucceeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Seq != head.Seq+1 || e.PrevHash != head.Hash {
+		t.Errorf("expected chain to continue from seq %d, got seq %d", head.Seq, e.Seq)
+	}
+}
+
+// TestAuditLogHeadFile 测试 .head 文件让截断或删除日志在重新打开时被发现，
+// 崩溃留下的多余记录被接受，写入失败时日志截回上一条完整记录
+func TestAuditLogHeadFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	appendN := func(t *testing.T, audit *AuditLog, n int) {
+		t.Helper()
+		for range n {
+			if _, err := audit.Append(AuditEntry{UserId: "user123", FileId: "file001", Step: "UpdateMetadata", Outcome: AuditSucceeded}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, audit, 2)
+	stale, err := os.ReadFile(path + ".head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, audit, 1)
+	audit.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	head, err := os.ReadFile(path + ".head")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := func(t *testing.T) {
+		t.Helper()
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path+".head", head, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name   string
+		tamper func() error
+	}{
+		{"truncated tail", func() error { return os.WriteFile(path, []byte(lines[0]+lines[1]), 0o600) }},
+		{"deleted log", func() error { return os.Remove(path) }},
+		{"deleted head", func() error { return os.Remove(path + ".head") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			restore(t)
+			if err := tc.tamper(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenAuditLog(path); !errors.Is(err, ErrAuditTampered) {
+				t.Errorf("expected ErrAuditTampered, got %v", err)
+			}
+		})
+	}
+
+	// 追加后、更新 .head 前崩溃：日志多出的记录仍然接在 .head 之后
+	restore(t)
+	if err := os.WriteFile(path+".head", stale, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	audit, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("expected a log ahead of its head file to be accepted, got %v", err)
+	}
+	if audit.Head().Seq != 3 {
+		t.Errorf("expected head at seq 3, got %d", audit.Head().Seq)
+	}
+
+	// .head 无法更新时这次追加失败，日志不留下这条记录，修复后继续追加
+	if err := os.Remove(path + ".head"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path+".head", "blocker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit.Append(AuditEntry{UserId: "user123", FileId: "file002", Step: "Authenticate", Outcome: AuditFailed}); err == nil {
+		t.Fatal("expected append to fail")
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(data) {
+		t.Errorf("failed append should be truncated away, log has %d bytes, want %d", len(got), len(data))
+	}
+	if err := os.RemoveAll(path + ".head"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".head", head, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, audit, 1)
+	audit.Close()
+
+	reopened, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Head().Seq != 4 {
+		t.Errorf("expected head at seq 4, got %d", reopened.Head().Seq)
+	}
+}
+
+// TestAuditLogDetectsTampering 测试修改、删除、截断记录都能被发现
+func TestAuditLogDetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 4 {
+		if _, err := audit.Append(AuditEntry{UserId: "user123", FileId: fmt.Sprintf("file%03d", i), Step: "UpdateMetadata", Outcome: AuditSucceeded}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := audit.Head()
+	audit.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines = lines[:len(lines)-1]
+
+	cases := []struct {
+		name string
+		log  string
+	}{
+		{"modified", strings.Replace(string(data), `"outcome":"succeeded"`, `"outcome":"failed"`, 1)},
+		{"deleted", lines[0] + lines[2] + lines[3]},
+		{"reordered", lines[1] + lines[0] + lines[2] + lines[3]},
+		{"truncated tail", lines[0] + lines[1] + lines[2]},
+		{"partial line", lines[0] + lines[1] + lines[2] + lines[3][:20]},
+		{"extra field", strings.Replace(lines[0], `{"seq"`, `{"note":"x","seq"`, 1) + lines[1] + lines[2] + lines[3]},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := VerifyAuditLog(strings.NewReader(tc.log), head); !errors.Is(err, ErrAuditTampered) {
+				t.Errorf("expected ErrAuditTampered, got %v", err)
+			}
+		})
+	}
+
+	os.WriteFile(path, []byte(cases[0].log), 0o600)
+	if _, err := OpenAuditLog(path); !errors.Is(err, ErrAuditTampered) {
+		t.Errorf("expected OpenAuditLog to refuse a tampered log, got %v", err)
+	}
+}
+
+// TestDescribeError 测试展开 errors.Join 产生的错误树，各层带上操作、ID 与标志，叶子是根因
+func TestDescribeError(t *testing.T) {
+	err := errors.Join(
+		fmt.Errorf("upload file failed: %w",
+			&RetryError{Step: "SaveMetadata", Attempts: 3, Err: NewMetadataError("SaveMetadata", "user123", "file001", &DeadlockError{})}),
+		fmt.Errorf("compensate DeleteFile: %w", NewStorageQuotaError("DeleteFile", "user123", "file001", context.DeadlineExceeded)),
+	)
+
+	n := DescribeError(err)
+	if n.Type != "*errors.joinError" || len(n.Causes) != 2 {
+		t.Fatalf("expected join with 2 causes, got %s with %d", n.Type, len(n.Causes))
+	}
+	retry := n.Causes[0].Causes[0]
+	if retry.Operation != "SaveMetadata" || retry.Attempts != 3 {
+		t.Errorf("unexpected retry layer %+v", retry)
+	}
+	meta := retry.Causes[0]
+	if meta.Type != "*main.MetadataError" || meta.UserId != "user123" || meta.FileId != "file001" || meta.Kind != "Aborted" {
+		t.Errorf("unexpected metadata layer %+v", meta)
+	}
+	if meta.Timeout == nil || *meta.Timeout || meta.Temporary == nil || !*meta.Temporary {
+		t.Errorf("expected timeout=false temporary=true, got %v %v", meta.Timeout, meta.Temporary)
+	}
+	storage := n.Causes[1].Causes[0]
+	if storage.Operation != "DeleteFile" || storage.Timeout == nil || !*storage.Timeout {
+		t.Errorf("unexpected storage layer %+v", storage)
+	}
+
+	var roots []string
+	for _, root := range n.RootCauses() {
+		roots = append(roots, root.Message)
+	}
+	if want := []string{"database deadlock", "context deadline exceeded"}; !slices.Equal(roots, want) {
+		t.Errorf("expected root causes %v, got %v", want, roots)
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Error("upload file failed", slog.Any("err", n))
+	var logged struct {
+		Err struct {
+			RootCause string `json:"rootCause"`
+			Causes    map[string]struct {
+				Causes map[string]struct {
+					Operation string `json:"operation"`
+				} `json:"causes"`
+			} `json:"causes"`
+		} `json:"err"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged.Err.RootCause != "database deadlock; context deadline exceeded" {
+		t.Errorf("unexpected rootCause %q", logged.Err.RootCause)
+	}
+	if op := logged.Err.Causes["1"].Causes["0"].Operation; op != "DeleteFile" {
+		t.Errorf("expected causes.1.causes.0.operation DeleteFile, got %q", op)
+	}
+
+	if _, err := json.Marshal(n); err != nil {
+		t.Errorf("marshal error tree: %v", err)
+	}
+	if DescribeError(nil) != nil {
+		t.Error("expected nil for nil error")
+	}
+}
+
+// TestMetadataErrorMessage 测试 MetadataError 的文本包含被包装的错误
+func TestMetadataErrorMessage(t *testing.T) {
+	err := NewMetadataError("SaveMetadata", "user123", "file001", &DeadlockError{})
+	if !strings.Contains(err.Error(), "database deadlock") {
+		t.Errorf("expected wrapped error in message, got %q", err.Error())
+	}
+}
+
+// TestNewUploadFileServiceValidation 测试缺少组件或必需步骤时构造失败，而不是上传时 panic
+func TestNewUploadFileServiceValidation(t *testing.T) {
+	meta := NewMetadataService()
+	storage := NewStorageService(WithRoot(t.TempDir()))
+	auth := NewAuthService()
+
+	testCases := []struct {
+		name string
+		opts []Option
+	}{
+		{"no authenticator", []Option{WithMeta(), WithStorage()}},
+		{"no metadata", []Option{WithAuth(), WithStorage()}},
+		{"no storage", []Option{WithAuth(), WithMeta()}},
+		{"nil storage", []Option{WithAuth(), WithMeta(), WithStorageService(nil)}},
+		{"typed nil authenticator", []Option{WithAuthenticator((*AuthService)(nil)), WithMeta(), WithStorage()}},
+		{"missing step", []Option{WithAuthenticator(auth), WithMetadataService(meta), WithStorageService(storage),
+			WithSteps(NewAuthStep(auth), NewMetadataStep(meta), NewStorageStep(storage))}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewUploadFileService(tc.opts...); !errors.Is(err, ErrMissingStep) {
+				t.Errorf("expected ErrMissingStep, got %v", err)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name  string
+		steps []UploadStep
+	}{
+		{"nil step", []UploadStep{NewAuthStep(auth), nil, NewMetadataStep(meta), NewStorageStep(storage), NewRecordStep(meta, storage)}},
+		{"typed nil step", []UploadStep{NewAuthStep(auth), (*scanStep)(nil), NewMetadataStep(meta), NewStorageStep(storage), NewRecordStep(meta, storage)}},
+		{"duplicate step", []UploadStep{NewAuthStep(auth), NewAuthStep(auth), NewMetadataStep(meta), NewStorageStep(storage), NewRecordStep(meta, storage)}},
+		{"auth not first", []UploadStep{NewMetadataStep(meta), NewAuthStep(auth), NewStorageStep(storage), NewRecordStep(meta, storage)}},
+		{"step before auth", []UploadStep{sniffStep{}, NewAuthStep(auth), NewMetadataStep(meta), NewStorageStep(storage), NewRecordStep(meta, storage)}},
+		{"update before save", []UploadStep{NewAuthStep(auth), NewStorageStep(storage), NewRecordStep(meta, storage), NewMetadataStep(meta)}},
+		{"update before upload", []UploadStep{NewAuthStep(auth), NewMetadataStep(meta), NewRecordStep(meta, storage), NewStorageStep(storage)}},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewUploadFileService(WithAuth(), WithMeta(), WithStorage(), WithSteps(tc.steps...)); err == nil {
+				t.Error("expected the pipeline to be rejected")
+			}
+		})
+	}
+}
+
+// sniffStep 在存储之前识别内容类型，只 Peek 开头部分，再把内容原样交给后续步骤
+type sniffStep struct{}
+
+func (sniffStep) Name() string { return "SniffContentType" }
+
+func (sniffStep) Run(ctx context.Context, rec *UploadRecord) error {
+	br := bufio.NewReader(rec.Body)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	rec.ContentType = http.DetectContentType(head)
+	rec.Body = br
+	return nil
+}
+
+// scanStep 在存储之后读取完整内容，发现特征串时拒绝上传
+type scanStep struct {
+	storage *StorageService
+	ctxKey  any
+	seen    []any
+}
+
+func (s *scanStep) Name() string { return "VirusScan" }
+
+func (s *scanStep) Run(ctx context.Context, rec *UploadRecord) error {
+	s.seen = append(s.seen, ctx.Value(s.ctxKey))
+	f, err := s.storage.Open(ctx, rec.UserId, rec.FileId)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("EICAR")) {
+		return fmt.Errorf("virus found in %s", rec.FileId)
+	}
+	if rec.Attributes == nil {
+		rec.Attributes = make(map[string]string)
+	}
+	rec.Attributes["scanned"] = "clean"
+	return nil
+}
+
+// TestPipelineCustomSteps 测试插入的步骤共享上传记录与请求 ctx，失败时回滚前面的步骤
+func TestPipelineCustomSteps(t *testing.T) {
+	type ctxKey struct{}
+	meta := NewMetadataService()
+	storage := NewStorageService(WithRoot(t.TempDir()))
+	auth := NewAuthService()
+	scan := &scanStep{storage: storage, ctxKey: ctxKey{}}
+
+	upload := newUploadService(t, WithAuthenticator(auth), WithMetadataService(meta), WithStorageService(storage),
+		WithSteps(
+			NewAuthStep(auth),
+			NewMetadataStep(meta),
+			sniffStep{},
+			NewStorageStep(storage),
+			scan,
+			NewRecordStep(meta, storage),
+		))
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request-1")
+	if err := upload.uploadFile(ctx, "user123", ValidApiKey, "page.html", strings.NewReader("<html><body>hi</body></html>")); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := meta.Get(ctx, "user123", "page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("expected sniffed content type, got %q", rec.ContentType)
+	}
+	if data := readStored(t, storage, "user123", "page.html"); data != "<html><body>hi</body></html>" {
+		t.Errorf("sniffing must not consume the body, got %q", data)
+	}
+	if len(scan.seen) != 1 || scan.seen[0] != "request-1" {
+		t.Errorf("expected step to receive the request ctx, got %v", scan.seen)
+	}
+
+	err = upload.uploadFile(ctx, "user123", ValidApiKey, "bad.txt", strings.NewReader("X5O!P%@AP EICAR"))
+	if err == nil || !strings.Contains(err.Error(), "virus found") {
+		t.Fatalf("expected scan failure, got %v", err)
+	}
+	if meta.HasMetadata("user123", "bad.txt") {
+		t.Error("expected metadata to be rolled back")
+	}
+	if _, err := storage.Stat(ctx, "user123", "bad.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected stored file to be rolled back, got %v", err)
+	}
+
+	// 覆盖已有文件失败时恢复原来的内容、引用计数与用量
+	before, err := storage.Stat(ctx, "user123", "page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = upload.uploadFile(ctx, "user123", ValidApiKey, "page.html", strings.NewReader("X5O!P%@AP EICAR"))
+	if err == nil || !strings.Contains(err.Error(), "virus found") {
+		t.Fatalf("expected scan failure, got %v", err)
+	}
+	if data := readStored(t, storage, "user123", "page.html"); data != "<html><body>hi</body></html>" {
+		t.Errorf("expected previous content to be restored, got %q", data)
+	}
+	if n, _ := storage.RefCount(before.Digest); n != 1 {
+		t.Errorf("expected previous content to be referenced once, got %d", n)
+	}
+	if used, _ := storage.Usage("user123"); used != before.Size {
+		t.Errorf("expected usage %d after rollback, got %d", before.Size, used)
+	}
+	if rec, _ := meta.Get(ctx, "user123", "page.html"); rec.Checksum != before.Digest {
+		t.Errorf("expected metadata to reference the previous content, got %q", rec.Checksum)
+	}
+}
+
+// TestUploadRecordLogValue 测试记录上传记录时不输出 API key
+func TestUploadRecordLogValue(t *testing.T) {
+	const secretKey = "sk-live-do-not-log-0123456789"
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	rec := &UploadRecord{UserId: "user123", FileId: "file001", ContentType: "text/plain", apiKey: secretKey}
+	log.Info("upload step", slog.Any("rec", rec))
+	if out := buf.String(); strings.Contains(out, secretKey) || !strings.Contains(out, `"fileId":"file001"`) {
+		t.Errorf("unexpected log output: %s", out)
+	}
+}
+
+// denyAll 是自定义的认证实现
+type denyAll struct{}
+
+func (denyAll) Authenticate(ctx context.Context, userId, apiKey string) error {
+	return NewAuthError("Authenticate", userId, apiKey, ErrInvalidUserId)
+}
+
+// TestWithAuthenticator 测试注入的认证实现同样用于会话与幂等重放
+func TestWithAuthenticator(t *testing.T) {
+	upload := newUploadService(t, WithAuthenticator(denyAll{}), WithMeta(), WithStorage(WithRoot(t.TempDir())))
+	ctx := context.Background()
+
+	if err := upload.uploadFile(ctx, "user123", ValidApiKey, "file001", strings.NewReader("hello")); KindOf(err) != KindPermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+	if _, err := upload.CreateSession(ctx, "user123", ValidApiKey, "file001", 1, sha256Hex("hello")); KindOf(err) != KindPermissionDenied {
+		t.Errorf("expected PermissionDenied from CreateSession, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrMetadataNotFound = errors.New("metadata not found")
+
+// FileRecord 是一个文件的元数据，Version 每次写入加一，用于乐观并发控制
+type FileRecord struct {
+	UserId      string    `json:"userId"`
+	FileId      string    `json:"fileId"`
+	Owner       string    `json:"owner"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Version     int64     `json:"version"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// VersionConflictError 表示写入时记录已被其他人修改。
+// 与 DeadlockError 一样，重新读取后重试即可，因此是临时错误。
+type VersionConflictError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict: expected %d, actual %d", e.Expected, e.Actual)
+}
+
+func (e *VersionConflictError) Temporary() bool {
+	return true
+}
+
+func (e *VersionConflictError) Kind() Kind {
+	return KindAborted
+}
+
+// metadataStore 只负责读写，版本检查由 MetadataService 在锁内完成
+type metadataStore interface {
+	get(userId, fileId string) (FileRecord, error)
+	list(userId string) ([]FileRecord, error)
+	put(rec FileRecord) error
+	delete(userId, fileId string) error
+}
+
+type memoryStore struct {
+	records map[string]FileRecord
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{records: make(map[string]FileRecord)}
+}
+
+func (s *memoryStore) get(userId, fileId string) (FileRecord, error) {
+	rec, ok := s.records[metadataKey(userId, fileId)]
+	if !ok {
+		return FileRecord{}, ErrMetadataNotFound
+	}
+	return rec, nil
+}
+
+func (s *memoryStore) list(userId string) ([]FileRecord, error) {
+	var recs []FileRecord
+	for _, rec := range s.records {
+		if rec.UserId == userId {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+func (s *memoryStore) put(rec FileRecord) error {
+	s.records[metadataKey(rec.UserId, rec.FileId)] = rec
+	return nil
+}
+
+func (s *memoryStore) delete(userId, fileId string) error {
+	delete(s.records, metadataKey(userId, fileId))
+	return nil
+}
+
+// fileStore 把每条记录保存为 dir/<userId>/<fileId>.json，
+// 先写临时文件再 rename，读者不会看到写了一半的记录。
+type fileStore struct {
+	dir string
+}
+
+func (s *fileStore) path(userId, fileId string) (string, error) {
+	if !validName(userId) || !validName(fileId) {
+		return "", ErrInvalidName
+	}
+	return filepath.Join(s.dir, userId, fileId+".json"), nil
+}
+
+func (s *fileStore) get(userId, fileId string) (FileRecord, error) {
+	path, err := s.path(userId, fileId)
+	if err != nil {
+		return FileRecord{}, err
+	}
+	return readRecord(path)
+}
+
+func (s *fileStore) list(userId string) ([]FileRecord, error) {
+	if !validName(userId) {
+		return nil, ErrInvalidName
+	}
+	entries, err := os.ReadDir(filepath.Join(s.dir, userId))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []FileRecord
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		rec, err := readRecord(filepath.Join(s.dir, userId, e.Name()))
+		if errors.Is(err, ErrMetadataNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func (s *fileStore) put(rec FileRecord) error {
+	path, err := s.path(rec.UserId, rec.FileId)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func (s *fileStore) delete(userId, fileId string) error {
+	path, err := s.path(userId, fileId)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func readRecord(path string) (FileRecord, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileRecord{}, ErrMetadataNotFound
+	}
+	if err != nil {
+		return FileRecord{}, err
+	}
+	var rec FileRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return FileRecord{}, fmt.Errorf("decode %s: %w", filepath.Base(path), err)
+	}
+	return rec, nil
+}
+
+func sortRecords(recs []FileRecord) {
+	slices.SortFunc(recs, func(a, b FileRecord) int {
+		return strings.Compare(a.FileId, b.FileId)
+	})
+}
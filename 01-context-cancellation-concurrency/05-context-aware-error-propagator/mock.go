@@ -1,12 +0,0 @@
-package main
-
-const (
-	ValidApiKey          = "valid_api_key"
-	TimeoutUserId        = "timeout_user"
-	InvalidUserId        = "invalid_user_id"
-	InvalidFileId        = "invalid_file_id"
-	TimeoutFileId        = "timeout_file_id"
-	DeadlockFileId       = "deadlock_file_id"
-	InvalidStorageUserId = "invalid_storage_user_id"
-	TimeoutStorageUserId = "timeout_storage_user_id"
-)
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+)
+
+var ErrMissingStep = errors.New("missing required upload step")
+
+// requiredSteps 是任何流水线都必须包含的步骤
+var requiredSteps = []string{"Authenticate", "SaveMetadata", "UploadFile", "UpdateMetadata"}
+
+// UploadRecord 是一次上传在各步骤之间共享的状态，每次调用 uploadFile 新建一个。
+// 需要检查内容的步骤应包装 Body（例如 io.TeeReader 或先 Peek 再拼回），不要自己读完；
+// 需要完整内容的步骤放在 UploadFile 之后，通过 Storage.Open 读取。
+// API key 只供认证步骤使用，不导出，记录日志时也不会输出。
+type UploadRecord struct {
+	UserId      string
+	FileId      string
+	Body        io.Reader
+	ContentType string
+	Blob        BlobRef
+	Attributes  map[string]string
+
+	// prevMeta 与 prevBlob 是覆盖前的元数据与存储引用，新建文件时为 nil，回滚时据此恢复而不是删除
+	prevMeta *FileRecord
+	prevBlob *BlobRef
+	apiKey   string
+	// authenticated 表示已在流水线之前用服务的 Authenticator 认证过，认证步骤不再重复校验
+	authenticated bool
+}
+
+// LogValue 实现 slog.LogValuer，只输出可以公开的字段
+func (r *UploadRecord) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("userId", r.UserId),
+		slog.String("fileId", r.FileId),
+		slog.String("contentType", r.ContentType),
+		slog.String("digest", r.Blob.Digest),
+		slog.Int64("size", r.Blob.Size),
+	)
+}
+
+// UploadStep 是上传流水线中的一个阶段，Name 用于重试、审计与错误信息
+type UploadStep interface {
+	Name() string
+	Run(ctx context.Context, rec *UploadRecord) error
+}
+
+// Compensator 由需要在失败时撤销的步骤实现，回滚时按步骤的逆序调用
+type Compensator interface {
+	Compensate(ctx context.Context, rec *UploadRecord) error
+}
+
+// BodyConsumer 由会读取 Body 的步骤实现。Body 不支持 Seek 时这类步骤不重试，
+// 支持时每次重试前把 Body 倒回开头。
+type BodyConsumer interface {
+	ConsumesBody() bool
+}
+
+// Authenticator 校验调用方的身份，AuthService 是默认实现
+type Authenticator interface {
+	Authenticate(ctx context.Context, userId, apiKey string) error
+}
+
+// Metadata 是流水线对元数据的读写，MetadataService 是默认实现
+type Metadata interface {
+	// ReplaceMetadata 创建或更新记录，记录已存在时返回写入前的记录
+	ReplaceMetadata(ctx context.Context, userId, fileId string) (*FileRecord, error)
+	Get(ctx context.Context, userId, fileId string) (FileRecord, error)
+	Put(ctx context.Context, rec FileRecord, expectedVersion int64) (FileRecord, error)
+	DeleteMetadata(ctx context.Context, userId, fileId string) error
+	RestoreMetadata(ctx context.Context, prev FileRecord) error
+}
+
+// Storage 是流水线对文件内容的读写，StorageService 是默认实现
+type Storage interface {
+	// ReplaceFile 写入文件，覆盖已有文件时返回被替换的引用
+	ReplaceFile(ctx context.Context, userId, fileId string, r io.Reader) (*BlobRef, error)
+	Stat(ctx context.Context, userId, fileId string) (BlobRef, error)
+	Open(ctx context.Context, userId, fileId string) (io.ReadCloser, error)
+	DeleteFile(ctx context.Context, userId, fileId string) error
+	RestoreFile(ctx context.Context, userId, fileId string, ref BlobRef) error
+}
+
+// WithAuthenticator 注入自定义的认证实现
+func WithAuthenticator(auth Authenticator) Option {
+	return func(upload *UploadFileService) {
+		upload.auth = auth
+	}
+}
+
+func WithMetadataService(meta Metadata) Option {
+	return func(upload *UploadFileService) {
+		upload.meta = meta
+	}
+}
+
+func WithStorageService(storage Storage) Option {
+	return func(upload *UploadFileService) {
+		upload.storage = storage
+	}
+}
+
+// WithSteps 用 steps 替换默认的流水线，可以在其中插入额外的步骤，
+// 但必须包含 requiredSteps 中的每一个，通常用 NewAuthStep 等函数创建。
+// Authenticate 必须是第一步，SaveMetadata 与 UploadFile 必须在 UpdateMetadata 之前。
+func WithSteps(steps ...UploadStep) Option {
+	return func(upload *UploadFileService) {
+		upload.steps = steps
+	}
+}
+
+// defaultSteps 是认证 → 元数据 → 存储 → 记录内容的默认流水线
+func defaultSteps(auth Authenticator, meta Metadata, storage Storage) []UploadStep {
+	return []UploadStep{
+		NewAuthStep(auth),
+		NewMetadataStep(meta),
+		NewStorageStep(storage),
+		NewRecordStep(meta, storage),
+	}
+}
+
+// validateSteps 检查流水线包含所有必需步骤且顺序正确：其他步骤都在认证之后执行，
+// UpdateMetadata 要更新已保存的记录并读取已存储的内容
+func validateSteps(steps []UploadStep) error {
+	pos := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if isNil(step) {
+			return fmt.Errorf("upload step %d is nil", i)
+		}
+		if _, ok := pos[step.Name()]; ok {
+			return fmt.Errorf("duplicate upload step %q", step.Name())
+		}
+		pos[step.Name()] = i
+	}
+	for _, name := range requiredSteps {
+		if _, ok := pos[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrMissingStep, name)
+		}
+	}
+	if pos["Authenticate"] != 0 {
+		return fmt.Errorf("upload step Authenticate must run first, got %q", steps[0].Name())
+	}
+	for _, name := range []string{"SaveMetadata", "UploadFile"} {
+		if pos[name] > pos["UpdateMetadata"] {
+			return fmt.Errorf("upload step %s must run before UpdateMetadata", name)
+		}
+	}
+	return nil
+}
+
+// isNil 同时识别 nil 接口与包装了 nil 指针的接口，后者与 nil 比较不相等，调用时才会 panic
+func isNil(v any) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// runStep 执行一个步骤，成功后登记补偿动作
+func (u *UploadFileService) runStep(ctx context.Context, rt *retrier, s *saga, step UploadStep, rec *UploadRecord) error {
+	consumer, _ := step.(BodyConsumer)
+	consumes := consumer != nil && consumer.ConsumesBody()
+
+	// 内容只能读一次，除非 Body 支持 Seek，否则不重试
+	if _, ok := rec.Body.(io.Seeker); consumes && !ok {
+		rt = rt.withoutRetries()
+	}
+	attempt := 0
+	if err := rt.do(ctx, step.Name(), func(ctx context.Context) error {
+		if attempt++; consumes && attempt > 1 && !rewind(rec.Body) {
+			return fmt.Errorf("%s: rewind upload body failed", step.Name())
+		}
+		return step.Run(ctx, rec)
+	}); err != nil {
+		return err
+	}
+
+	if c, ok := step.(Compensator); ok {
+		s.add(step.Name(), func(ctx context.Context) error {
+			return c.Compensate(ctx, rec)
+		})
+	}
+	return nil
+}
+
+type authStep struct {
+	auth Authenticator
+}
+
+func NewAuthStep(auth Authenticator) UploadStep {
+	return &authStep{auth: auth}
+}
+
+func (s *authStep) Name() string { return "Authenticate" }
+
+func (s *authStep) Run(ctx context.Context, rec *UploadRecord) error {
+	if rec.authenticated {
+		return nil
+	}
+	return s.auth.Authenticate(ctx, rec.UserId, rec.apiKey)
+}
+
+type metadataStep struct {
+	meta Metadata
+}
+
+func NewMetadataStep(meta Metadata) UploadStep {
+	return &metadataStep{meta: meta}
+}
+
+func (s *metadataStep) Name() string { return "SaveMetadata" }
+
+func (s *metadataStep) Run(ctx context.Context, rec *UploadRecord) error {
+	prev, err := s.meta.ReplaceMetadata(ctx, rec.UserId, rec.FileId)
+	if err != nil {
+		return err
+	}
+	rec.prevMeta = prev
+	return nil
+}
+
+// Compensate 删除新建的记录；覆盖已有文件时恢复原来的记录
+func (s *metadataStep) Compensate(ctx context.Context, rec *UploadRecord) error {
+	if rec.prevMeta != nil {
+		return s.meta.RestoreMetadata(ctx, *rec.prevMeta)
+	}
+	return s.meta.DeleteMetadata(ctx, rec.UserId, rec.FileId)
+}
+
+type storageStep struct {
+	storage Storage
+}
+
+func NewStorageStep(storage Storage) UploadStep {
+	return &storageStep{storage: storage}
+}
+
+func (s *storageStep) Name() string       { return "UploadFile" }
+func (s *storageStep) ConsumesBody() bool { return true }
+
+func (s *storageStep) Run(ctx context.Context, rec *UploadRecord) error {
+	prev, err := s.storage.ReplaceFile(ctx, rec.UserId, rec.FileId, rec.Body)
+	if err != nil {
+		return err
+	}
+	rec.prevBlob = prev
+	return nil
+}
+
+// Compensate 删除新建的文件；覆盖已有文件时恢复原来的引用
+func (s *storageStep) Compensate(ctx context.Context, rec *UploadRecord) error {
+	if rec.prevBlob != nil {
+		return s.storage.RestoreFile(ctx, rec.UserId, rec.FileId, *rec.prevBlob)
+	}
+	return s.storage.DeleteFile(ctx, rec.UserId, rec.FileId)
+}
+
+// recordStep 把内容的摘要、大小与类型写入元数据，即元数据对存储内容的引用
+type recordStep struct {
+	meta    Metadata
+	storage Storage
+}
+
+func NewRecordStep(meta Metadata, storage Storage) UploadStep {
+	return &recordStep{meta: meta, storage: storage}
+}
+
+func (s *recordStep) Name() string { return "UpdateMetadata" }
+
+func (s *recordStep) Run(ctx context.Context, rec *UploadRecord) error {
+	ref, err := s.storage.Stat(ctx, rec.UserId, rec.FileId)
+	if err != nil {
+		return err
+	}
+	rec.Blob = ref
+
+	cur, err := s.meta.Get(ctx, rec.UserId, rec.FileId)
+	if err != nil {
+		return err
+	}
+	cur.Size, cur.Checksum = ref.Size, ref.Digest
+	if rec.ContentType != "" {
+		cur.ContentType = rec.ContentType
+	}
+	_, err = s.meta.Put(ctx, cur, cur.Version)
+	return err
+}
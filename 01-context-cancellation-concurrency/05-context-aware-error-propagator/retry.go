@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+)
+
+// Clock 抽象时间，测试中可以替换为不真正等待的实现
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RetryPolicy 控制 uploadFile 对临时错误的重试
+type RetryPolicy struct {
+	// MaxRetries 一次 uploadFile 调用内所有步骤共享的重试次数预算
+	MaxRetries int
+	// BaseDelay 第一次重试前的退避上限，之后每次翻倍
+	BaseDelay time.Duration
+	// MaxDelay 单次退避的上限
+	MaxDelay time.Duration
+	Clock    Clock
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	BaseDelay:  50 * time.Millisecond,
+	MaxDelay:   time.Second,
+	Clock:      realClock{},
+}
+
+// RetryError 记录某个步骤最终失败前一共尝试了多少次。
+// 只有重试过的步骤才会返回它，第一次就放弃的错误原样返回。
+type RetryError struct {
+	Step     string
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempts: %v", e.Step, e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// WithRetry 开启对 Temporary() 错误的重试
+func WithRetry(policy RetryPolicy) Option {
+	return func(upload *UploadFileService) {
+		if policy.Clock == nil {
+			policy.Clock = realClock{}
+		}
+		upload.retry = &policy
+	}
+}
+
+// retrier 保存一次调用剩余的重试预算
+type retrier struct {
+	policy    *RetryPolicy
+	remaining int
+}
+
+func newRetrier(policy *RetryPolicy) *retrier {
+	if policy == nil {
+		return &retrier{}
+	}
+	return &retrier{policy: policy, remaining: policy.MaxRetries}
+}
+
+// withoutRetries 返回不会重试、也不消耗预算的 retrier
+func (r *retrier) withoutRetries() *retrier {
+	return &retrier{policy: r.policy}
+}
+
+// do 执行 fn，遇到临时错误时按带抖动的指数退避重试，ctx 取消后立即停止
+func (r *retrier) do(ctx context.Context, step string, fn func(ctx context.Context) error) error {
+	if r.policy == nil {
+		return fn(ctx)
+	}
+
+	attempts := 0
+	for {
+		attempts++
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if !temporary(err) || r.remaining <= 0 || ctx.Err() != nil {
+			if attempts == 1 {
+				return err
+			}
+			return &RetryError{Step: step, Attempts: attempts, Err: err}
+		}
+		r.remaining--
+
+		select {
+		case <-ctx.Done():
+			return &RetryError{Step: step, Attempts: attempts, Err: errors.Join(err, ctx.Err())}
+		case <-r.policy.Clock.After(r.policy.backoff(attempts)):
+		}
+	}
+}
+
+// backoff 返回第 attempt 次失败后的等待时间，使用 full jitter：[0, min(MaxDelay, BaseDelay*2^(attempt-1)))
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+func temporary(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// rewind 尝试把上传内容倒回开头，不支持 Seek 的 reader 无法安全重试
+func rewind(r io.Reader) bool {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return false
+	}
+	_, err := s.Seek(0, io.SeekStart)
+	return err == nil
+}
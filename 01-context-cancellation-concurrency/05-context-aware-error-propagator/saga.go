@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const DefaultCompensationTimeout = 5 * time.Second
+
+type compensation struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// saga 记录已完成步骤的补偿动作，后续步骤失败时按相反顺序执行
+type saga struct {
+	timeout       time.Duration
+	compensations []compensation
+}
+
+func newSaga(timeout time.Duration) *saga {
+	return &saga{timeout: timeout}
+}
+
+func (s *saga) add(name string, fn func(ctx context.Context) error) {
+	s.compensations = append(s.compensations, compensation{name: name, fn: fn})
+}
+
+// rollback 执行所有补偿动作，把补偿失败的错误合并到原始错误上。
+// 补偿使用与调用方取消解耦的 ctx，调用方超时后清理仍会进行。
+func (s *saga) rollback(ctx context.Context, cause error) error {
+	if len(s.compensations) == 0 {
+		return cause
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	errs := []error{cause}
+	for i := len(s.compensations) - 1; i >= 0; i-- {
+		c := s.compensations[i]
+		if err := c.fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("compensate %s: %w", c.name, err))
+		}
+	}
+	s.compensations = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionNotFound   = errors.New("upload session not found")
+	ErrChecksumMismatch  = errors.New("checksum mismatch")
+	ErrChunkOutOfRange   = errors.New("chunk index out of range")
+	ErrChunkTooLarge     = errors.New("chunk too large")
+	ErrSessionIncomplete = errors.New("upload session incomplete")
+	ErrSessionBusy       = errors.New("upload session is being finalized")
+
+	// 会话数和暂存分片超出用户限额，都归为配额不足
+	ErrTooManySessions = fmt.Errorf("%w: too many open upload sessions", ErrQuotaExceeded)
+	ErrStagingExceeded = fmt.Errorf("%w: too many staged chunk bytes", ErrQuotaExceeded)
+)
+
+const (
+	DefaultSessionTTL   = 24 * time.Hour
+	DefaultMaxChunkSize = 8 << 20
+	MaxSessionChunks    = 10000
+
+	DefaultMaxUserSessions = 16
+	DefaultMaxStagedBytes  = DefaultUserQuota
+)
+
+type SessionError struct {
+	ServiceError
+	SessionId string
+}
+
+func NewSessionError(op, sessionId, userId, fileId string, err error) *SessionError {
+	return &SessionError{
+		ServiceError: newServiceError(op, userId, fileId, err),
+		SessionId:    sessionId,
+	}
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("upload session %q failed for user %q file %q during %s at %s %v", e.SessionId,
+		e.UserId, e.FileId, e.Operation, e.timestamp.Format(time.RFC3339), e.Err)
+}
+
+// SessionStatus 是会话的快照，客户端据此决定还需要上传哪些分片
+type SessionStatus struct {
+	Id          string
+	UserId      string
+	FileId      string
+	TotalChunks int
+	Received    []int
+	Missing     []int
+	ExpiresAt   time.Time
+}
+
+type uploadSession struct {
+	id          string
+	userId      string
+	fileId      string
+	totalChunks int
+	checksum    string
+	dir         string
+
+	mu         sync.Mutex
+	received   map[int]int64 // 已收到分片的大小
+	updatedAt  time.Time
+	writing    int
+	finalizing bool
+}
+
+type SessionOption func(*sessionManager)
+
+// sessionManager 管理分片上传会话，分片暂存在 dir/<sessionId>/ 下
+type sessionManager struct {
+	dir          string
+	ttl          time.Duration
+	maxChunkSize int64
+	maxSessions  int
+	maxStaged    int64
+	clock        Clock
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+	staged   map[string]int64 // 每个用户已暂存和正在写入的分片字节数
+}
+
+func newSessionManager(opts ...SessionOption) *sessionManager {
+	m := &sessionManager{
+		dir:          filepath.Join(os.TempDir(), "upload-sessions"),
+		ttl:          DefaultSessionTTL,
+		maxChunkSize: DefaultMaxChunkSize,
+		maxSessions:  DefaultMaxUserSessions,
+		maxStaged:    DefaultMaxStagedBytes,
+		clock:        realClock{},
+		sessions:     make(map[string]*uploadSession),
+		staged:       make(map[string]int64),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func WithSessionDir(dir string) SessionOption {
+	return func(m *sessionManager) {
+		m.dir = dir
+	}
+}
+
+// WithSessionTTL 设置会话在最后一次活动后多久过期
+func WithSessionTTL(ttl time.Duration) SessionOption {
+	return func(m *sessionManager) {
+		m.ttl = ttl
+	}
+}
+
+func WithMaxChunkSize(size int64) SessionOption {
+	return func(m *sessionManager) {
+		m.maxChunkSize = size
+	}
+}
+
+// WithMaxUserSessions 限制每个用户同时打开的会话数
+func WithMaxUserSessions(n int) SessionOption {
+	return func(m *sessionManager) {
+		m.maxSessions = n
+	}
+}
+
+// WithMaxStagedBytes 限制每个用户所有会话暂存分片的总字节数
+func WithMaxStagedBytes(n int64) SessionOption {
+	return func(m *sessionManager) {
+		m.maxStaged = n
+	}
+}
+
+func WithSessionClock(clock Clock) SessionOption {
+	return func(m *sessionManager) {
+		m.clock = clock
+	}
+}
+
+// WithSessions 配置分片上传会话
+func WithSessions(opts ...SessionOption) Option {
+	return func(upload *UploadFileService) {
+		upload.sessions = newSessionManager(opts...)
+	}
+}
+
+// CreateSession 认证后创建上传会话，checksum 为完整文件的 SHA-256（十六进制）
+func (u *UploadFileService) CreateSession(ctx context.Context, userId, apiKey, fileId string,
+	totalChunks int, checksum string) (SessionStatus, error) {
+	if err := u.auth.Authenticate(ctx, userId, apiKey); err != nil {
+		return SessionStatus{}, fmt.Errorf("create session failed: %w", err)
+	}
+
+	m := u.sessions
+	fail := func(err error) (SessionStatus, error) {
+		return SessionStatus{}, NewSessionError("CreateSession", "", userId, fileId, err)
+	}
+	if !validName(userId) || !validName(fileId) {
+		return fail(ErrInvalidName)
+	}
+	if totalChunks <= 0 || totalChunks > MaxSessionChunks {
+		return fail(fmt.Errorf("%w: %d chunks", ErrChunkOutOfRange, totalChunks))
+	}
+	if _, err := hex.DecodeString(checksum); err != nil || len(checksum) != sha256.Size*2 {
+		return fail(fmt.Errorf("%w: malformed sha256 %q", ErrChecksumMismatch, checksum))
+	}
+
+	checksum = strings.ToLower(checksum)
+	id := newSessionId()
+	s := &uploadSession{
+		id:          id,
+		userId:      userId,
+		fileId:      fileId,
+		totalChunks: totalChunks,
+		checksum:    checksum,
+		dir:         filepath.Join(m.dir, id),
+		received:    make(map[int]int64),
+		updatedAt:   m.clock.Now(),
+	}
+	if err := m.register(s); err != nil {
+		return fail(err)
+	}
+	return m.status(s), nil
+}
+
+// UploadChunk 写入第 index 个分片（从 0 开始），checksum 为该分片的 SHA-256。
+// 重复上传同一分片会覆盖之前的内容，因此断线后可以直接重传。
+func (u *UploadFileService) UploadChunk(ctx context.Context, sessionId, apiKey string, index int,
+	checksum string, r io.Reader) error {
+	m := u.sessions
+	s, err := m.get(sessionId)
+	if err != nil {
+		return NewSessionError("UploadChunk", sessionId, "", "", err)
+	}
+	if err := u.auth.Authenticate(ctx, s.userId, apiKey); err != nil {
+		return fmt.Errorf("upload chunk failed: %w", err)
+	}
+
+	fail := func(err error) error {
+		return NewSessionError("UploadChunk", sessionId, s.userId, s.fileId, err)
+	}
+	if index < 0 || index >= s.totalChunks {
+		return fail(fmt.Errorf("%w: %d of %d", ErrChunkOutOfRange, index, s.totalChunks))
+	}
+	limit, err := m.reserveChunk(s)
+	if err != nil {
+		return fail(err)
+	}
+
+	n, err := m.writeChunk(ctx, s, index, strings.ToLower(checksum), r, limit)
+	m.settleChunk(s, index, limit, n, err)
+	if err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// SessionStatus 返回会话已收到和缺失的分片
+func (u *UploadFileService) SessionStatus(ctx context.Context, sessionId, apiKey string) (SessionStatus, error) {
+	s, err := u.sessions.get(sessionId)
+	if err != nil {
+		return SessionStatus{}, NewSessionError("SessionStatus", sessionId, "", "", err)
+	}
+	if err := u.auth.Authenticate(ctx, s.userId, apiKey); err != nil {
+		return SessionStatus{}, fmt.Errorf("session status failed: %w", err)
+	}
+	return u.sessions.status(s), nil
+}
+
+// FinalizeSession 按顺序拼接分片并校验整体 checksum，通过后走正常的上传流程写入元数据与存储
+func (u *UploadFileService) FinalizeSession(ctx context.Context, sessionId, apiKey string) error {
+	m := u.sessions
+	s, err := m.get(sessionId)
+	if err != nil {
+		return NewSessionError("FinalizeSession", sessionId, "", "", err)
+	}
+	if err := u.auth.Authenticate(ctx, s.userId, apiKey); err != nil {
+		return fmt.Errorf("finalize session failed: %w", err)
+	}
+
+	fail := func(err error) error {
+		return NewSessionError("FinalizeSession", sessionId, s.userId, s.fileId, err)
+	}
+
+	if err := m.reserve(s, true); err != nil {
+		return fail(err)
+	}
+	defer func() {
+		s.mu.Lock()
+		s.finalizing = false
+		s.updatedAt = m.clock.Now()
+		s.mu.Unlock()
+	}()
+
+	f, err := m.assemble(ctx, s)
+	if err != nil {
+		return fail(err)
+	}
+
+	err = u.uploadFile(ctx, s.userId, apiKey, s.fileId, f)
+	cleanupErr := errors.Join(f.Close(), os.Remove(f.Name()))
+	if err != nil {
+		return errors.Join(fmt.Errorf("finalize session failed: %w", err), cleanupErr)
+	}
+
+	m.remove(s)
+	return nil
+}
+
+// CollectExpiredSessions 删除超过 TTL 未活动的会话及其暂存数据，
+// 同时清理目录中不属于任何会话的残留数据（例如进程重启前的会话），返回清理的会话数。
+func (u *UploadFileService) CollectExpiredSessions() (int, error) {
+	return u.sessions.collect()
+}
+
+// RunSessionGC 每隔 interval 清理一次过期会话，直到 ctx 结束
+func (u *UploadFileService) RunSessionGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.sessions.collect()
+		}
+	}
+}
+
+func (m *sessionManager) get(sessionId string) (*uploadSession, error) {
+	m.mu.Lock()
+	s, ok := m.sessions[sessionId]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.expired(s) {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+// register 检查用户的会话数后登记会话并创建暂存目录
+func (m *sessionManager) register(s *uploadSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	open := 0
+	for _, other := range m.sessions {
+		if other.userId == s.userId {
+			open++
+		}
+	}
+	if m.maxSessions > 0 && open >= m.maxSessions {
+		return fmt.Errorf("%w: %d of %d", ErrTooManySessions, open, m.maxSessions)
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	m.sessions[s.id] = s
+	return nil
+}
+
+// reserveChunk 登记一次分片写入，并从用户的暂存额度中预留本次最多能写入的字节数。
+// 预留在写入前完成，并发写入的分片加起来也不会超出额度。
+func (m *sessionManager) reserveChunk(s *uploadSession) (int64, error) {
+	if err := m.reserve(s, false); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limit := m.maxChunkSize
+	if m.maxStaged > 0 {
+		limit = min(limit, m.maxStaged-m.staged[s.userId])
+	}
+	if limit <= 0 {
+		s.mu.Lock()
+		s.writing--
+		s.mu.Unlock()
+		return 0, fmt.Errorf("%w: limit %d bytes", ErrStagingExceeded, m.maxStaged)
+	}
+	m.staged[s.userId] += limit
+	return limit, nil
+}
+
+// settleChunk 结束一次分片写入：释放预留额度，成功时改为记入分片的实际大小，
+// 覆盖同号分片时扣除旧分片的大小
+func (m *sessionManager) settleChunk(s *uploadSession, index int, reserved, n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.staged[s.userId] -= reserved
+	if err == nil {
+		m.staged[s.userId] += n - s.received[index]
+		s.received[index] = n
+	}
+	if m.staged[s.userId] == 0 {
+		delete(m.staged, s.userId)
+	}
+	s.writing--
+	s.updatedAt = m.clock.Now()
+}
+
+// release 归还会话占用的暂存额度，调用方需持有 m.mu，且会话已没有进行中的写入
+func (m *sessionManager) release(s *uploadSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.received {
+		m.staged[s.userId] -= n
+	}
+	if m.staged[s.userId] == 0 {
+		delete(m.staged, s.userId)
+	}
+}
+
+// reserve 确认 s 仍是登记中的有效会话，并在同一把锁内登记一次分片写入（finalize 为 false）
+// 或合并（finalize 为 true）。登记后的会话不会过期，GC 不会删除正在使用的会话。
+// 认证在 get 与 reserve 之间进行，期间会话可能已被 GC 删除，因此这里要重新查找。
+func (m *sessionManager) reserve(s *uploadSession, finalize bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[s.id] != s {
+		return ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case m.expired(s):
+		return ErrSessionNotFound
+	case s.finalizing, finalize && s.writing > 0:
+		return ErrSessionBusy
+	case !finalize:
+		s.writing++
+	case len(s.received) != s.totalChunks:
+		return fmt.Errorf("%w: %d of %d chunks received", ErrSessionIncomplete, len(s.received), s.totalChunks)
+	default:
+		s.finalizing = true
+	}
+	return nil
+}
+
+// expired 调用方需持有 s.mu
+func (m *sessionManager) expired(s *uploadSession) bool {
+	return !s.finalizing && s.writing == 0 && !m.clock.Now().Before(s.updatedAt.Add(m.ttl))
+}
+
+func (m *sessionManager) status(s *uploadSession) SessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := SessionStatus{
+		Id:          s.id,
+		UserId:      s.userId,
+		FileId:      s.fileId,
+		TotalChunks: s.totalChunks,
+		ExpiresAt:   s.updatedAt.Add(m.ttl),
+	}
+	for i := range s.totalChunks {
+		if _, ok := s.received[i]; ok {
+			st.Received = append(st.Received, i)
+		} else {
+			st.Missing = append(st.Missing, i)
+		}
+	}
+	return st
+}
+
+// writeChunk 先写临时文件，校验通过后再 rename 成分片文件，失败时不影响已有的同号分片。
+// limit 是本次预留的字节数，小于 maxChunkSize 时说明受暂存额度限制。
+func (m *sessionManager) writeChunk(ctx context.Context, s *uploadSession, index int, checksum string,
+	r io.Reader, limit int64) (n int64, err error) {
+	tmp, err := os.CreateTemp(s.dir, ".chunk-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, tmp.Close(), os.Remove(tmp.Name()))
+		}
+	}()
+
+	h := sha256.New()
+	n, err = io.Copy(io.MultiWriter(tmp, h), &ctxReader{ctx: ctx, r: io.LimitReader(r, limit+1)})
+	switch {
+	case err != nil:
+		return 0, err
+	case n > m.maxChunkSize:
+		return 0, fmt.Errorf("%w: limit %d bytes", ErrChunkTooLarge, m.maxChunkSize)
+	case n > limit:
+		return 0, fmt.Errorf("%w: limit %d bytes", ErrStagingExceeded, m.maxStaged)
+	}
+	if err := verifyChecksum(h, checksum); err != nil {
+		return 0, fmt.Errorf("chunk %d: %w", index, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), chunkPath(s, index))
+}
+
+// assemble 把分片按顺序拼接成完整文件并校验 checksum，返回的文件已 Seek 到开头
+func (m *sessionManager) assemble(ctx context.Context, s *uploadSession) (*os.File, error) {
+	f, err := os.CreateTemp(s.dir, ".assembled-*")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		return nil, errors.Join(err, f.Close(), os.Remove(f.Name()))
+	}
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	for i := range s.totalChunks {
+		if err := appendChunk(ctx, w, chunkPath(s, i)); err != nil {
+			return fail(err)
+		}
+	}
+	if err := verifyChecksum(h, s.checksum); err != nil {
+		return fail(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return f, nil
+}
+
+func (m *sessionManager) remove(s *uploadSession) {
+	m.mu.Lock()
+	delete(m.sessions, s.id)
+	m.release(s)
+	m.mu.Unlock()
+	os.RemoveAll(s.dir)
+}
+
+func (m *sessionManager) collect() (int, error) {
+	m.mu.Lock()
+	var expired []*uploadSession
+	for id, s := range m.sessions {
+		s.mu.Lock()
+		dead := m.expired(s)
+		s.mu.Unlock()
+		if dead {
+			expired = append(expired, s)
+			delete(m.sessions, id)
+			m.release(s)
+		}
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, s := range expired {
+		errs = append(errs, os.RemoveAll(s.dir))
+	}
+
+	// 清理不属于任何会话且超过 TTL 未修改的目录
+	entries, err := os.ReadDir(m.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	deadline := m.clock.Now().Add(-m.ttl)
+	for _, e := range entries {
+		m.mu.Lock()
+		_, live := m.sessions[e.Name()]
+		m.mu.Unlock()
+		if live || !e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(deadline) {
+			continue
+		}
+		errs = append(errs, os.RemoveAll(filepath.Join(m.dir, e.Name())))
+	}
+	return len(expired), errors.Join(errs...)
+}
+
+func appendChunk(ctx context.Context, w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, &ctxReader{ctx: ctx, r: f})
+	return err
+}
+
+func verifyChecksum(h hash.Hash, want string) error {
+	got := hex.EncodeToString(h.Sum(nil))
+	if got != want {
+		return fmt.Errorf("%w: got %s, want %s", ErrChecksumMismatch, got, want)
+	}
+	return nil
+}
+
+func chunkPath(s *uploadSession, index int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("chunk-%06d", index))
+}
+
+func newSessionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ctxReader 每次 Read 前检查 ctx，让 io.Copy 能及时停止
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -2,17 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
+var (
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	ErrInvalidName   = errors.New("invalid storage name")
+	// ErrFileTooLarge 单个文件就超过了配额，与已用空间无关
+	ErrFileTooLarge = fmt.Errorf("%w: file larger than quota", ErrQuotaExceeded)
+)
+
+const (
+	DefaultUserQuota = 100 << 20 // 每个用户默认 100MB
+	copyBufferSize   = 32 << 10
+)
+
 type StorageQuotaError struct {
-	Operation string
-	UserId    string
-	FileId    string
-	timestamp time.Time
-	Err       error
+	ServiceError
 }
 
 func (e *StorageQuotaError) Error() string {
@@ -20,47 +37,530 @@ func (e *StorageQuotaError) Error() string {
 		e.FileId, e.Operation, e.timestamp.Format(time.RFC3339), e.Err)
 }
 
-func (e *StorageQuotaError) Unwrap() error {
-	return e.Err
+func NewStorageQuotaError(op, userId, fileId string, err error) *StorageQuotaError {
+	return &StorageQuotaError{
+		ServiceError: newServiceError(op, userId, fileId, err),
+	}
 }
 
-func (e *StorageQuotaError) Timeout() bool {
-	return errors.Is(e.Err, context.DeadlineExceeded)
+type StorageOption func(*StorageService)
+
+// BlobRef 是用户文件对内容的引用，Digest 为内容的 SHA-256
+type BlobRef struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
 }
 
-func (e *StorageQuotaError) Temporary() bool {
-	// 配额错误不是临时的，但超时错误是临时的
-	if errors.Is(e.Err, context.DeadlineExceeded) {
-		return true
+// StorageService 按内容寻址存储上传的文件，相同内容只保存一份：
+//
+//	root/blobs/<digest[:2]>/<digest>  内容
+//	root/refs/<userId>/<fileId>       用户文件到内容的引用（BlobRef JSON）
+//	root/tmp/                         正在上传的临时文件
+//
+// 配额按用户的引用计算，即使内容与其他文件共享也照常计费。
+// 不再被引用的内容由 CollectGarbage 删除。
+type StorageService struct {
+	root  string
+	quota int64
+
+	// mu 保护用量与引用计数，同时让提交引用与垃圾回收互斥
+	mu      sync.Mutex
+	usage   map[string]int64
+	refs    map[string]int
+	pending map[string]bool
+}
+
+func NewStorageService(opts ...StorageOption) *StorageService {
+	s := &StorageService{
+		root:    filepath.Join(os.TempDir(), "upload-storage"),
+		quota:   DefaultUserQuota,
+		usage:   make(map[string]int64),
+		pending: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
-	// 配额超限不是临时错误，不能通过重试解决
-	return false
+	return s
 }
 
-func NewStorageQuotaError(op, userId, fileId string, err error) *StorageQuotaError {
-	return &StorageQuotaError{
-		Operation: op,
-		UserId:    userId,
-		FileId:    fileId,
-		timestamp: time.Now(),
-		Err:       err,
+func WithRoot(root string) StorageOption {
+	return func(s *StorageService) {
+		s.root = root
 	}
 }
 
-type StorageService struct {
+func WithQuota(quota int64) StorageOption {
+	return func(s *StorageService) {
+		s.quota = quota
+	}
+}
+
+func (s *StorageService) UploadFile(ctx context.Context, userId, fileId string, r io.Reader) error {
+	_, err := s.ReplaceFile(ctx, userId, fileId, r)
+	return err
+}
+
+// ReplaceFile 与 UploadFile 相同，覆盖已有文件时另外返回被替换的引用，供补偿时恢复
+func (s *StorageService) ReplaceFile(ctx context.Context, userId, fileId string, r io.Reader) (*BlobRef, error) {
+	if ctx.Err() != nil {
+		return nil, NewStorageQuotaError("UploadFile", userId, fileId, ctx.Err())
+	}
+
+	old, err := s.upload(ctx, userId, fileId, r)
+	if err != nil {
+		return nil, NewStorageQuotaError("UploadFile", userId, fileId, err)
+	}
+	return old, nil
+}
+
+// DeleteFile 删除用户对文件的引用并释放配额，用于上传失败后的补偿。
+// 内容本身在没有任何引用后由 CollectGarbage 删除。
+func (s *StorageService) DeleteFile(ctx context.Context, userId, fileId string) error {
+	if ctx.Err() != nil {
+		return NewStorageQuotaError("DeleteFile", userId, fileId, ctx.Err())
+	}
+	if !validName(userId) || !validName(fileId) {
+		return NewStorageQuotaError("DeleteFile", userId, fileId, ErrInvalidName)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadRefs(); err != nil {
+		return NewStorageQuotaError("DeleteFile", userId, fileId, err)
+	}
+
+	path := s.refPath(userId, fileId)
+	ref, err := readRef(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return NewStorageQuotaError("DeleteFile", userId, fileId, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return NewStorageQuotaError("DeleteFile", userId, fileId, err)
+	}
+
+	s.refs[ref.Digest]--
+	// 用量尚未加载时下次扫描目录自然不包含该文件，无需扣减
+	if _, ok := s.usage[userId]; ok {
+		s.usage[userId] -= ref.Size
+	}
+	return nil
 }
 
-func (s *StorageService) UploadFile(ctx context.Context, userId, fileId string) error {
+// RestoreFile 把用户文件的引用恢复为 ref，用于覆盖已有文件后后续步骤失败时的补偿。
+// ref 的内容已被垃圾回收时返回 fs.ErrNotExist。
+func (s *StorageService) RestoreFile(ctx context.Context, userId, fileId string, ref BlobRef) error {
 	if ctx.Err() != nil {
-		return NewStorageQuotaError("UploadFile", userId, fileId, ctx.Err())
+		return NewStorageQuotaError("RestoreFile", userId, fileId, ctx.Err())
+	}
+	if !validName(userId) || !validName(fileId) {
+		return NewStorageQuotaError("RestoreFile", userId, fileId, ErrInvalidName)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadRefs(); err != nil {
+		return NewStorageQuotaError("RestoreFile", userId, fileId, err)
+	}
+	if _, err := os.Stat(s.blobPath(ref.Digest)); err != nil {
+		return NewStorageQuotaError("RestoreFile", userId, fileId, err)
 	}
 
-	if userId == InvalidStorageUserId {
-		return NewStorageQuotaError("UploadFile", userId, fileId, errors.New("invalid userId"))
+	path := s.refPath(userId, fileId)
+	cur, curErr := readRef(path)
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return NewStorageQuotaError("RestoreFile", userId, fileId, err)
 	}
-	if userId == TimeoutStorageUserId {
-		return NewStorageQuotaError("UploadFile", userId, fileId, context.DeadlineExceeded)
+	if err := writeFileAtomic(path, data); err != nil {
+		return NewStorageQuotaError("RestoreFile", userId, fileId, err)
 	}
 
+	// 与 DeleteFile 相同，用量尚未加载时下次扫描目录自然得到正确的值
+	_, loaded := s.usage[userId]
+	s.refs[ref.Digest]++
+	if loaded {
+		s.usage[userId] += ref.Size
+	}
+	if curErr == nil {
+		s.refs[cur.Digest]--
+		if loaded {
+			s.usage[userId] -= cur.Size
+		}
+	}
 	return nil
 }
+
+// Stat 返回用户文件引用的内容
+func (s *StorageService) Stat(ctx context.Context, userId, fileId string) (BlobRef, error) {
+	if ctx.Err() != nil {
+		return BlobRef{}, NewStorageQuotaError("Stat", userId, fileId, ctx.Err())
+	}
+	if !validName(userId) || !validName(fileId) {
+		return BlobRef{}, NewStorageQuotaError("Stat", userId, fileId, ErrInvalidName)
+	}
+
+	ref, err := readRef(s.refPath(userId, fileId))
+	if err != nil {
+		return BlobRef{}, NewStorageQuotaError("Stat", userId, fileId, err)
+	}
+	return ref, nil
+}
+
+// Open 打开用户文件的内容
+func (s *StorageService) Open(ctx context.Context, userId, fileId string) (io.ReadCloser, error) {
+	ref, err := s.Stat(ctx, userId, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	// 持锁打开，避免刚读到引用就被并发的 DeleteFile + CollectGarbage 删掉内容
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.blobPath(ref.Digest))
+	if err != nil {
+		return nil, NewStorageQuotaError("Open", userId, fileId, err)
+	}
+	return f, nil
+}
+
+// RefCount 返回内容当前被多少个用户文件引用
+func (s *StorageService) RefCount(digest string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadRefs(); err != nil {
+		return 0, err
+	}
+	return s.refs[digest], nil
+}
+
+// Usage 返回用户当前已占用的字节数
+func (s *StorageService) Usage(userId string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadUsage(userId)
+}
+
+// CollectGarbage 删除没有任何引用的内容以及残留的临时文件，返回删除的内容数。
+// 与上传提交持同一把锁，回收期间上传可以继续写临时文件，只是提交会稍作等待。
+func (s *StorageService) CollectGarbage(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadRefs(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	var errs []error
+	err := filepath.WalkDir(filepath.Join(s.root, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || s.refs[d.Name()] > 0 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		delete(s.refs, d.Name())
+		removed++
+		return nil
+	})
+	errs = append(errs, err)
+
+	// 正在写入的临时文件不能删
+	entries, err := os.ReadDir(filepath.Join(s.root, "tmp"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	for _, e := range entries {
+		path := filepath.Join(s.root, "tmp", e.Name())
+		if !s.pending[path] {
+			errs = append(errs, os.Remove(path))
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// upload 写入内容并提交引用，返回被覆盖的旧引用，新建文件时为 nil
+func (s *StorageService) upload(ctx context.Context, userId, fileId string, r io.Reader) (old *BlobRef, err error) {
+	if !validName(userId) {
+		return nil, fmt.Errorf("%w: user %q", ErrInvalidName, userId)
+	}
+	if !validName(fileId) {
+		return nil, fmt.Errorf("%w: file %q", ErrInvalidName, fileId)
+	}
+
+	tmpDir := filepath.Join(s.root, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// 先写临时文件，边写边算 SHA-256，提交时再移动到内容目录，避免留下半截文件
+	// 持锁创建并登记，避免并发的 CollectGarbage 把刚创建的文件当作残留删除
+	s.mu.Lock()
+	tmp, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.pending[tmp.Name()] = true
+	s.mu.Unlock()
+
+	// 覆盖同名文件时旧引用的配额在提交时才释放，检查配额时先把它算作可用
+	var credit int64
+	if prev, err := readRef(s.refPath(userId, fileId)); err == nil {
+		credit = prev.Size
+	}
+
+	var charged int64
+	committed, closed := false, false
+	defer func() {
+		if err != nil {
+			s.release(userId, charged)
+			if !closed {
+				err = errors.Join(err, tmp.Close())
+			}
+			if !committed {
+				err = errors.Join(err, os.Remove(tmp.Name()))
+			}
+		}
+		s.mu.Lock()
+		delete(s.pending, tmp.Name())
+		s.mu.Unlock()
+	}()
+
+	h := sha256.New()
+	w := io.MultiWriter(tmp, h)
+	buf := make([]byte, copyBufferSize)
+	for {
+		// 每读一块检查一次 ctx，取消后尽快停止
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if charged+int64(n) > s.quota {
+				return nil, ErrFileTooLarge
+			}
+			if err := s.charge(userId, int64(n), credit); err != nil {
+				return nil, err
+			}
+			charged += int64(n)
+			if _, err := w.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+
+	closed = true
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	ref := BlobRef{Digest: hex.EncodeToString(h.Sum(nil)), Size: charged}
+	committed, old, err = s.commit(userId, fileId, tmp.Name(), ref)
+	return old, err
+}
+
+// commit 把临时文件移动为内容（已存在则丢弃）并写入引用。
+// 返回临时文件是否已被处理，调用方据此决定是否还需要删除它，以及被覆盖的旧引用。
+func (s *StorageService) commit(userId, fileId, tmpPath string, ref BlobRef) (bool, *BlobRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadRefs(); err != nil {
+		return false, nil, err
+	}
+
+	blob := s.blobPath(ref.Digest)
+	handled := false
+	if _, err := os.Stat(blob); err == nil {
+		// 相同内容已经存在，只增加引用
+		if err := os.Remove(tmpPath); err != nil {
+			return false, nil, err
+		}
+		handled = true
+	} else {
+		if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+			return false, nil, err
+		}
+		if err := os.Rename(tmpPath, blob); err != nil {
+			return false, nil, err
+		}
+		handled = true
+	}
+
+	refPath := s.refPath(userId, fileId)
+	old, oldErr := readRef(refPath)
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return handled, nil, err
+	}
+	if err := writeFileAtomic(refPath, data); err != nil {
+		return handled, nil, err
+	}
+
+	s.refs[ref.Digest]++
+	if oldErr != nil {
+		return handled, nil, nil
+	}
+	// 覆盖同名文件时释放旧引用占用的配额。空文件不会调用 charge，
+	// 用量可能尚未加载，此时与 DeleteFile 相同，下次扫描目录自然得到正确的值
+	s.refs[old.Digest]--
+	if _, ok := s.usage[userId]; ok {
+		s.usage[userId] -= old.Size
+	}
+	return handled, &old, nil
+}
+
+// charge 在写入前预占 n 字节，超出配额时返回 ErrQuotaExceeded。
+// credit 是提交后会被释放的字节数，即被覆盖的旧文件大小。
+func (s *StorageService) charge(userId string, n, credit int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, err := s.loadUsage(userId)
+	if err != nil {
+		return err
+	}
+	if used-credit+n > s.quota {
+		return fmt.Errorf("%w: used %d - %d + %d > quota %d", ErrQuotaExceeded, used, credit, n, s.quota)
+	}
+	s.usage[userId] = used + n
+	return nil
+}
+
+func (s *StorageService) release(userId string, n int64) {
+	if n == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage[userId] -= n
+}
+
+// loadUsage 首次访问时汇总用户所有引用的大小，调用方需持有 s.mu
+func (s *StorageService) loadUsage(userId string) (int64, error) {
+	if used, ok := s.usage[userId]; ok {
+		return used, nil
+	}
+
+	var used int64
+	err := walkRefs(filepath.Join(s.root, "refs", userId), func(ref BlobRef) {
+		used += ref.Size
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.usage[userId] = used
+	return used, nil
+}
+
+// loadRefs 首次访问时扫描所有引用统计引用计数，调用方需持有 s.mu
+func (s *StorageService) loadRefs() error {
+	if s.refs != nil {
+		return nil
+	}
+
+	refs := make(map[string]int)
+	err := walkRefs(filepath.Join(s.root, "refs"), func(ref BlobRef) {
+		refs[ref.Digest]++
+	})
+	if err != nil {
+		return err
+	}
+	s.refs = refs
+	return nil
+}
+
+func (s *StorageService) refPath(userId, fileId string) string {
+	return filepath.Join(s.root, "refs", userId, fileId)
+}
+
+func (s *StorageService) blobPath(digest string) string {
+	return filepath.Join(s.root, "blobs", digest[:2], digest)
+}
+
+func readRef(path string) (BlobRef, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return BlobRef{}, err
+	}
+	var ref BlobRef
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return BlobRef{}, fmt.Errorf("decode ref %s: %w", filepath.Base(path), err)
+	}
+	return ref, nil
+}
+
+func walkRefs(dir string, fn func(ref BlobRef)) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		ref, err := readRef(path)
+		if err != nil {
+			return err
+		}
+		fn(ref)
+		return nil
+	})
+}
+
+// writeFileAtomic 先写同目录下的临时文件再 rename，读者不会看到写了一半的内容
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	closed := false
+	defer func() {
+		if err != nil {
+			if !closed {
+				err = errors.Join(err, tmp.Close())
+			}
+			err = errors.Join(err, os.Remove(tmp.Name()))
+		}
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	closed = true
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\`) && filepath.IsLocal(name)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// StatusError 表示上游返回了非 200 的状态码
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("api error: %d", e.StatusCode)
+}
+
+// AdaptiveConfig 配置 AIMD 调速：被限流时速率乘以 Decrease，成功时每个 Interval 最多加一次 Increase，
+// 始终保持在 [Floor, Ceiling] 之间。同一次拥塞只降速一次：降速之前发出的请求随后返回的 429 不再降速。
+// 零值字段使用默认值：Ceiling 为桶配置的速率，Floor 为 Ceiling 的 1%，Decrease 为 0.5，
+// Increase 为 Ceiling 的 5%，Interval 为 1s。
+type AdaptiveConfig struct {
+	Floor    rate.Limit
+	Ceiling  rate.Limit
+	Decrease float64
+	Increase rate.Limit
+	Interval time.Duration
+}
+
+// WithAdaptiveRate 根据 429、Retry-After 与 RateLimit-Remaining/RateLimit-Reset 自动调整速率
+func WithAdaptiveRate(cfg AdaptiveConfig) Option {
+	return func(f *FanOutClient) {
+		f.buckets.adaptive = &cfg
+	}
+}
+
+// EffectiveRate 返回 Endpoint 所在主机当前生效的每秒请求数
+func (f *FanOutClient) EffectiveRate() float64 {
+	u, err := url.Parse(f.endpoint.BaseURL)
+	if err != nil {
+		return f.buckets.def.Rate
+	}
+	return f.EffectiveRateFor(u.Host)
+}
+
+// EffectiveRateFor 返回 key 对应的桶当前生效的每秒请求数，桶尚未创建时返回其配置的速率
+func (f *FanOutClient) EffectiveRateFor(key string) float64 {
+	if b, ok := f.buckets.peek(key); ok {
+		return float64(b.limiter.Limit())
+	}
+	if limits, ok := f.buckets.limits[key]; ok {
+		return limits.Rate
+	}
+	return f.buckets.def.Rate
+}
+
+// adaptiveRate 调整一个桶的 limiter，并在上游要求暂停时阻止该桶新的请求
+type adaptiveRate struct {
+	cfg     AdaptiveConfig
+	limiter Limiter
+
+	mu           sync.Mutex
+	pausedUntil  time.Time
+	lastDecrease time.Time
+	lastIncrease time.Time
+}
+
+// init 在创建桶时补全默认值，此时才知道桶的初始速率
+func (a *adaptiveRate) init(limiter Limiter) {
+	a.limiter = limiter
+	if a.cfg.Ceiling <= 0 {
+		a.cfg.Ceiling = limiter.Limit()
+	}
+	if a.cfg.Floor <= 0 {
+		a.cfg.Floor = a.cfg.Ceiling / 100
+	}
+	if a.cfg.Decrease <= 0 || a.cfg.Decrease >= 1 {
+		a.cfg.Decrease = 0.5
+	}
+	if a.cfg.Increase <= 0 {
+		a.cfg.Increase = a.cfg.Ceiling / 20
+	}
+	if a.cfg.Interval <= 0 {
+		a.cfg.Interval = time.Second
+	}
+	limiter.SetLimit(a.clamp(limiter.Limit()))
+}
+
+func (a *adaptiveRate) clamp(r rate.Limit) rate.Limit {
+	return min(max(r, a.cfg.Floor), a.cfg.Ceiling)
+}
+
+// wait 在上游要求的暂停期间阻塞，ctx 取消时立即返回
+func (a *adaptiveRate) wait(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	d := time.Until(a.pausedUntil)
+	a.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observe 根据 sent 时刻发出的请求的响应调整速率，返回上游要求等待的时间
+func (a *adaptiveRate) observe(resp *http.Response, sent time.Time) time.Duration {
+	if a == nil {
+		return retryAfter(resp.Header)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	cur := a.limiter.Limit()
+	wait := retryAfter(resp.Header)
+	throttled := resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusServiceUnavailable && wait > 0)
+
+	switch {
+	case throttled && sent.After(a.lastDecrease):
+		cur = rate.Limit(float64(cur) * a.cfg.Decrease)
+		a.lastDecrease, a.lastIncrease = now, now
+	case throttled:
+		// 降速前就已发出的请求反映的是降速前的速率，这次拥塞已经处理过
+	case resp.StatusCode < 400 && now.Sub(a.lastIncrease) >= a.cfg.Interval:
+		cur += a.cfg.Increase
+		a.lastIncrease = now
+	}
+
+	// 上游公布了剩余配额时，按剩余配额在重置前均匀发送，不超过加性增长后的速率
+	if remaining, reset, ok := rateLimitHeaders(resp.Header); ok {
+		if remaining == 0 {
+			wait = max(wait, reset)
+		} else if reset > 0 {
+			cur = min(cur, rate.Limit(float64(remaining)/reset.Seconds()))
+		}
+	}
+
+	a.limiter.SetLimit(a.clamp(cur))
+	if wait > 0 {
+		if until := now.Add(wait); until.After(a.pausedUntil) {
+			a.pausedUntil = until
+		}
+	}
+	return wait
+}
+
+// retryAfter 解析秒数或 HTTP 日期两种格式的 Retry-After
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// rateLimitHeaders 解析 RateLimit-Remaining 与 RateLimit-Reset（秒）
+func rateLimitHeaders(h http.Header) (remaining int, reset time.Duration, ok bool) {
+	rv, sv := h.Get("RateLimit-Remaining"), h.Get("RateLimit-Reset")
+	if rv == "" || sv == "" {
+		return 0, 0, false
+	}
+	remaining, err := strconv.Atoi(rv)
+	if err != nil || remaining < 0 {
+		return 0, 0, false
+	}
+	secs, err := strconv.Atoi(sv)
+	if err != nil || secs < 0 {
+		return 0, 0, false
+	}
+	return remaining, time.Duration(secs) * time.Second, true
+}
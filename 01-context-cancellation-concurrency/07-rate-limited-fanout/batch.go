@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	DefaultBatchPath   = "/avatar/info?ids={ids}"
+	DefaultBatchSize   = 50
+	DefaultMaxURLBytes = 2048
+)
+
+// BatchDecoder 把批量响应拆分为每个用户的结果。缺少的用户会被单独重新请求。
+type BatchDecoder func(body []byte, userIDs []int) (map[int][]byte, error)
+
+// JSONBatchDecoder 解析以用户 ID 为键的 JSON 对象，例如 {"1": {...}, "2": {...}}，
+// 每个用户的结果是对应值的原始 JSON
+func JSONBatchDecoder(body []byte, userIDs []int) (map[int][]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("decode batch: %w", err)
+	}
+	results := make(map[int][]byte, len(userIDs))
+	for _, userId := range userIDs {
+		if v, ok := raw[strconv.Itoa(userId)]; ok {
+			results[userId] = v
+		}
+	}
+	return results, nil
+}
+
+// Batch 配置批量请求。Path 中的 {ids} 会被替换为逗号分隔的用户 ID，
+// 每批最多 MaxIDs 个用户，且完整 URL 不超过 MaxURLBytes 字节。零值字段使用默认值。
+type Batch struct {
+	Path        string
+	MaxIDs      int
+	MaxURLBytes int
+	Decode      BatchDecoder
+}
+
+// WithBatch 让 FetchAll 把用户打包为批量请求，每批只占用一个 limiter token
+func WithBatch(b Batch) Option {
+	return func(f *FanOutClient) {
+		if b.Path == "" {
+			b.Path = DefaultBatchPath
+		}
+		if b.MaxIDs <= 0 {
+			b.MaxIDs = DefaultBatchSize
+		}
+		if b.MaxURLBytes <= 0 {
+			b.MaxURLBytes = DefaultMaxURLBytes
+		}
+		if b.Decode == nil {
+			b.Decode = JSONBatchDecoder
+		}
+		f.batch = &b
+	}
+}
+
+// batchURL 返回 userIDs 对应的批量请求地址
+func (f *FanOutClient) batchURL(userIDs []int) string {
+	ids := make([]string, len(userIDs))
+	for i, userId := range userIDs {
+		ids[i] = strconv.Itoa(userId)
+	}
+	path := strings.ReplaceAll(f.batch.Path, "{ids}", strings.Join(ids, ","))
+	return strings.TrimRight(f.endpoint.BaseURL, "/") + path
+}
+
+// batches 按 MaxIDs 与 MaxURLBytes 切分 userIDs，单个用户超出 URL 长度时独占一批
+func (f *FanOutClient) batches(userIDs []int) [][]int {
+	base := len(f.batchURL(nil))
+	var (
+		out  [][]int
+		cur  []int
+		size int
+	)
+	for _, userId := range userIDs {
+		n := len(strconv.Itoa(userId))
+		if len(cur) > 0 {
+			n++ // 逗号
+		}
+		if len(cur) > 0 && (len(cur) >= f.batch.MaxIDs || base+size+n > f.batch.MaxURLBytes) {
+			out = append(out, cur)
+			cur, size, n = nil, 0, n-1
+		}
+		cur = append(cur, userId)
+		size += n
+	}
+	if len(cur) > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// fetchBatch 发送一个批量请求并拆分结果，只返回响应中包含的用户
+func (f *FanOutClient) fetchBatch(ctx context.Context, userIDs []int) (map[int][]byte, error) {
+	req, err := f.endpoint.request(ctx, f.batchURL(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	body, err := f.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return f.batch.Decode(body, userIDs)
+}
+
+// fetchAllBatched 按批请求，批量请求失败或响应缺少某些用户时，这些用户改为单独请求
+func (f *FanOutClient) fetchAllBatched(ctx context.Context, userIDs []int) (map[int][]byte, error) {
+	g, ctx := errgroup.WithContext(ctx)
+	results := make(map[int][]byte)
+	mu := &sync.Mutex{}
+
+	fetchOne := func(userId int) error {
+		start := time.Now()
+		data, err := f.FetchOne(ctx, userId)
+
+		slog.Info("request completed",
+			slog.Int("userID", userId),
+			slog.Duration("latency", time.Since(start)),
+			slog.Bool("success", err == nil))
+
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		results[userId] = data
+		mu.Unlock()
+		return nil
+	}
+
+	for _, ids := range f.batches(userIDs) {
+		g.Go(func() error {
+			start := time.Now()
+			data, err := f.fetchBatch(ctx, ids)
+
+			slog.Info("batch completed",
+				slog.Int("size", len(ids)),
+				slog.Duration("latency", time.Since(start)),
+				slog.Bool("success", err == nil))
+
+			var missing []int
+			mu.Lock()
+			for _, userId := range ids {
+				if v, ok := data[userId]; ok {
+					results[userId] = v
+				} else {
+					missing = append(missing, userId)
+				}
+			}
+			mu.Unlock()
+
+			for _, userId := range missing {
+				g.Go(func() error { return fetchOne(userId) })
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+// DefaultBucketIdleTimeout 是桶在没有请求后保留的时间
+const DefaultBucketIdleTimeout = 5 * time.Minute
+
+// HostLimits 是一个桶的速率、突发与并发上限
+type HostLimits struct {
+	Rate        float64
+	Burst       int
+	MaxInFlight int64
+}
+
+// WithHostLimits 为 key（主机名或调用方通过 WithBucketKey 指定的键）单独设置限额，
+// 未设置的 key 使用构造函数参数给出的默认限额
+func WithHostLimits(key string, limits HostLimits) Option {
+	return func(f *FanOutClient) {
+		f.buckets.limits[key] = limits
+	}
+}
+
+// WithBucketIdleTimeout 设置空闲桶被回收前保留的时间
+func WithBucketIdleTimeout(d time.Duration) Option {
+	return func(f *FanOutClient) {
+		f.buckets.idleTimeout = d
+	}
+}
+
+type bucketKeyCtx struct{}
+
+// WithBucketKey 让 ctx 上的请求使用 key 对应的桶，而不是按请求的主机名分桶
+func WithBucketKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, bucketKeyCtx{}, key)
+}
+
+// bucketKey 优先使用调用方指定的键，否则使用请求的主机名
+func bucketKey(ctx context.Context, u *url.URL) string {
+	if key, ok := ctx.Value(bucketKeyCtx{}).(string); ok && key != "" {
+		return key
+	}
+	return u.Host
+}
+
+// bucket 是一个主机独占的限流器与并发池，慢主机只会占满自己的并发
+type bucket struct {
+	limiter  Limiter
+	sem      *semaphore.Weighted
+	gate     *priorityGate
+	adaptive *adaptiveRate
+
+	// 以下字段由 bucketPool.mu 保护
+	active   int
+	lastUsed time.Time
+}
+
+type bucketPool struct {
+	def         HostLimits
+	limits      map[string]HostLimits
+	backend     LimiterBackend
+	adaptive    *AdaptiveConfig
+	idleTimeout time.Duration
+	aging       time.Duration
+	waits       *queueStats
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	nextSweep time.Time
+}
+
+func newBucketPool(def HostLimits) *bucketPool {
+	return &bucketPool{
+		def:         def,
+		limits:      make(map[string]HostLimits),
+		backend:     LocalBackend{},
+		idleTimeout: DefaultBucketIdleTimeout,
+		aging:       DefaultPriorityAging,
+		waits:       &queueStats{stats: make(map[Priority]QueueStats)},
+		buckets:     make(map[string]*bucket),
+	}
+}
+
+// acquire 返回 key 对应的桶并标记为使用中，用完后必须调用 release
+func (p *bucketPool) acquire(key string) *bucket {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+
+	b, ok := p.buckets[key]
+	if !ok {
+		b = p.newBucket(key)
+		p.buckets[key] = b
+	}
+	b.active++
+	b.lastUsed = now
+	return b
+}
+
+func (p *bucketPool) release(b *bucket) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.active--
+	b.lastUsed = time.Now()
+}
+
+// peek 返回已存在的桶，不会创建新桶
+func (p *bucketPool) peek(key string) (*bucket, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.buckets[key]
+	return b, ok
+}
+
+func (p *bucketPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.buckets)
+}
+
+func (p *bucketPool) newBucket(key string) *bucket {
+	limits, ok := p.limits[key]
+	if !ok {
+		limits = p.def
+	}
+	b := &bucket{
+		limiter: p.backend.NewLimiter(key, rate.Limit(limits.Rate), limits.Burst),
+		sem:     semaphore.NewWeighted(max(limits.MaxInFlight, 1)),
+	}
+	b.gate = &priorityGate{sem: b.sem, limiter: b.limiter, aging: p.aging, waits: p.waits}
+	if p.adaptive != nil {
+		b.adaptive = &adaptiveRate{cfg: *p.adaptive}
+		b.adaptive.init(b.limiter)
+	}
+	return b
+}
+
+// sweep 回收空闲超时且没有进行中请求的桶，调用方需持有 p.mu
+func (p *bucketPool) sweep(now time.Time) {
+	if p.idleTimeout <= 0 || now.Before(p.nextSweep) {
+		return
+	}
+	for key, b := range p.buckets {
+		if b.active == 0 && now.Sub(b.lastUsed) >= p.idleTimeout {
+			delete(p.buckets, key)
+		}
+	}
+	p.nextSweep = now.Add(p.idleTimeout / 2)
+}
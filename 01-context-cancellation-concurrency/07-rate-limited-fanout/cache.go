@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheBytes 是响应缓存默认的容量
+const DefaultCacheBytes = 16 << 20
+
+// WithCache 缓存成功的响应，总大小不超过 maxBytes（<= 0 时使用 DefaultCacheBytes）。
+// 未过期的响应直接从缓存返回；过期后带 If-None-Match/If-Modified-Since 重新验证，
+// 上游返回 304 时使用缓存的内容。遵守 Cache-Control 的 max-age、no-cache 与 no-store。
+// 缓存由所有调用方共用：请求头（包括 Endpoint.Header、Auth 与 WithRequestHeader 添加的）
+// 不同的请求不共用条目，Vary 列出的请求头不同时不使用缓存，private 或 Vary: * 的响应不缓存。
+func WithCache(maxBytes int64) Option {
+	return func(f *FanOutClient) {
+		if maxBytes <= 0 {
+			maxBytes = DefaultCacheBytes
+		}
+		f.cache = newResponseCache(maxBytes)
+	}
+}
+
+type cacheEntry struct {
+	key          string
+	vary         map[string]string
+	body         []byte
+	etag         string
+	lastModified string
+	expires      time.Time
+}
+
+// responseCache 是按 URL 与请求头索引、按总字节数淘汰最久未使用条目的缓存，
+// 每个键只保存最近一次响应对应的 Vary 变体
+type responseCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newResponseCache(maxBytes int64) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// lookup 返回 req 对应的缓存条目以及它是否仍然新鲜。
+// 条目过期时为 req 添加条件请求头，缓存为 nil 时总是返回 nil。
+func (c *responseCache) lookup(req *http.Request) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	elem, ok := c.entries[cacheKey(req)]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	e := *elem.Value.(*cacheEntry)
+	c.mu.Unlock()
+
+	for name, value := range e.vary {
+		if headerValue(req.Header, name) != value {
+			return nil, false
+		}
+	}
+
+	if time.Now().Before(e.expires) {
+		return &e, true
+	}
+	if e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	if e.lastModified != "" {
+		req.Header.Set("If-Modified-Since", e.lastModified)
+	}
+	return &e, false
+}
+
+// revalidated 在上游返回 304 后更新条目的有效期与验证器
+func (c *responseCache) revalidated(prev *cacheEntry, h http.Header) {
+	e := *prev
+	if v := h.Get("ETag"); v != "" {
+		e.etag = v
+	}
+	if v := h.Get("Last-Modified"); v != "" {
+		e.lastModified = v
+	}
+	e.expires = time.Time{}
+	if maxAge, noStore := cacheControl(h); noStore {
+		c.remove(e.key)
+		return
+	} else if maxAge > 0 {
+		e.expires = time.Now().Add(maxAge)
+	}
+	c.put(&e)
+}
+
+// store 保存 200 响应的副本；no-store、private、Vary: * 或既没有验证器也没有有效期的响应不缓存
+func (c *responseCache) store(req *http.Request, h http.Header, body []byte) {
+	if c == nil {
+		return
+	}
+	key := cacheKey(req)
+	maxAge, noStore := cacheControl(h)
+	vary, ok := varyValues(req, h)
+	if !ok {
+		noStore = true
+	}
+	e := &cacheEntry{
+		key:          key,
+		vary:         vary,
+		body:         bytes.Clone(body),
+		etag:         h.Get("ETag"),
+		lastModified: h.Get("Last-Modified"),
+	}
+	if maxAge > 0 {
+		e.expires = time.Now().Add(maxAge)
+	}
+	if noStore || (e.etag == "" && e.lastModified == "" && maxAge <= 0) {
+		c.remove(key)
+		return
+	}
+	c.put(e)
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(e.key)
+	if int64(len(e.body)) > c.maxBytes {
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += int64(len(e.body))
+	for c.size > c.maxBytes {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+func (c *responseCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *responseCache) removeLocked(key string) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, key)
+	c.size -= int64(len(elem.Value.(*cacheEntry).body))
+}
+
+// conditionalHeaders 是 lookup 自己添加的条件请求头，不参与缓存键
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// cacheKey 返回 req 的缓存键。凭据可能放在任意请求头中，所以键覆盖所有请求头，
+// 请求头不同的请求不共用条目；请求头只以摘要的形式出现在键中，缓存不保存凭据原文。
+func cacheKey(req *http.Request) string {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		if !slices.Contains(conditionalHeaders, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return req.URL.String()
+	}
+	slices.Sort(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name + ":" + headerValue(req.Header, name) + "\n"))
+	}
+	return req.URL.String() + " " + hex.EncodeToString(h.Sum(nil))
+}
+
+// varyValues 返回响应的 Vary 列出的请求头在 req 中的值，Vary: * 时 ok 为 false
+func varyValues(req *http.Request, h http.Header) (vary map[string]string, ok bool) {
+	for _, v := range h.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch name {
+			case "":
+				continue
+			case "*":
+				return nil, false
+			}
+			if vary == nil {
+				vary = make(map[string]string)
+			}
+			vary[name] = headerValue(req.Header, name)
+		}
+	}
+	return vary, true
+}
+
+func headerValue(h http.Header, name string) string {
+	return strings.Join(h.Values(name), ", ")
+}
+
+// cacheControl 解析 Cache-Control 中的 max-age 与 no-store，no-cache 视为 max-age=0。
+// 缓存由所有调用方共用，private 按 no-store 处理。
+func cacheControl(h http.Header) (maxAge time.Duration, noStore bool) {
+	noCache := false
+	for _, v := range h.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "private":
+				noStore = true
+			case "no-cache":
+				noCache = true
+			case "max-age":
+				if secs, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && secs > 0 {
+					maxAge = time.Duration(secs) * time.Second
+				}
+			}
+		}
+	}
+	if noCache {
+		maxAge = 0
+	}
+	return maxAge, noStore
+}
+
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record 是 CLI 输出中每个用户的一行 NDJSON。Status 为上游的状态码，
+// 请求没有得到响应（超时、取消等）时为 0
+type Record struct {
+	UserId    int     `json:"userId"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+	Body      string  `json:"body,omitempty"`
+}
+
+// summary 是一次运行的统计，写到 stderr
+type summary struct {
+	total, skipped, succeeded, failed int
+	elapsed                           time.Duration
+}
+
+func (s summary) String() string {
+	pending := s.total - s.skipped - s.succeeded - s.failed
+	return fmt.Sprintf("total=%d skipped=%d succeeded=%d failed=%d pending=%d elapsed=%v",
+		s.total, s.skipped, s.succeeded, s.failed, pending, s.elapsed.Round(time.Millisecond))
+}
+
+// runCLI 从 -in（默认 stdin）读取用户 ID，逐行把结果写到 -out（默认 stdout）。
+// -out 指向已有文件时跳过其中已经成功的用户，重新请求失败的用户并追加写入，实现断点续跑。
+// -url 为空时使用客户端默认的 DefaultBaseURL 与 DefaultPath。
+// ctx 被取消时停止发起新请求，已写出的行保持完整。
+// 设置 -serve-coordinator 时改为运行 Coordinator，直到 ctx 被取消。
+func runCLI(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("rate-limited-fanout", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	limit := flags.Float64("rate", 10, "requests per second")
+	burst := flags.Int("burst", 20, "limiter burst")
+	inFlight := flags.Int64("in-flight", 8, "max requests in flight")
+	tmpl := flags.String("url", "", "URL template, {userId} is replaced by each ID (default "+DefaultBaseURL+DefaultPath+")")
+	in := flags.String("in", "", "file with user IDs, one or more per line (default stdin)")
+	out := flags.String("out", "", "NDJSON output file, resumed if it exists (default stdout)")
+	coordinator := flags.String("coordinator", "", "Unix socket of a shared rate limit coordinator")
+	serve := flags.String("serve-coordinator", "", "run a rate limit coordinator on this Unix socket instead of fetching")
+	verbose := flags.Bool("v", false, "log every request")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *serve != "" {
+		c := NewCoordinator()
+		stop := context.AfterFunc(ctx, func() { c.Close() })
+		defer stop()
+		return c.ListenAndServe(*serve)
+	}
+
+	var opts []Option
+	if *tmpl != "" {
+		endpoint, err := endpointFromTemplate(*tmpl)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, WithEndpoint(endpoint))
+	}
+	if !*verbose {
+		defer slog.SetLogLoggerLevel(slog.SetLogLoggerLevel(slog.LevelWarn))
+	}
+
+	var src io.Reader = stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	ids, err := readUserIDs(src)
+	if err != nil {
+		return err
+	}
+
+	var dst io.Writer = stdout
+	done := map[int]bool{}
+	if *out != "" {
+		f, seen, err := openResumable(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst, done = f, seen
+	}
+
+	sum := summary{total: len(ids)}
+	pending := ids[:0]
+	for _, id := range ids {
+		if done[id] {
+			sum.skipped++
+		} else {
+			pending = append(pending, id)
+		}
+	}
+
+	if *coordinator != "" {
+		backend := NewCoordinatorBackend(*coordinator)
+		defer backend.Close()
+		opts = append(opts, WithLimiterBackend(backend))
+	}
+	client := NewFanOutClient(*limit, *burst, *inFlight, opts...)
+
+	start := time.Now()
+	enc := json.NewEncoder(dst)
+	for userId, res := range client.FetchStream(ctx, pending) {
+		if res.Err != nil && ctx.Err() != nil {
+			// 因中断而失败的用户不写出，续跑时会重新请求
+			continue
+		}
+		rec := newRecord(userId, res)
+		if rec.Error == "" {
+			sum.succeeded++
+		} else {
+			sum.failed++
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	sum.elapsed = time.Since(start)
+	fmt.Fprintln(stderr, sum)
+
+	return ctx.Err()
+}
+
+func newRecord(userId int, res StreamResult) Record {
+	rec := Record{
+		UserId:    userId,
+		Status:    http.StatusOK,
+		LatencyMs: float64(res.Latency.Microseconds()) / 1000,
+		Body:      string(res.Data),
+	}
+	if res.Err != nil {
+		rec.Status = 0
+		rec.Error = res.Err.Error()
+		var statusErr *StatusError
+		if errors.As(res.Err, &statusErr) {
+			rec.Status = statusErr.StatusCode
+		}
+	}
+	return rec
+}
+
+// endpointFromTemplate 把完整的 URL 模板拆分为 Endpoint 的 BaseURL 与 Path
+func endpointFromTemplate(tmpl string) (Endpoint, error) {
+	if !strings.Contains(tmpl, "{userId}") {
+		return Endpoint{}, fmt.Errorf("url template %q has no {userId} placeholder", tmpl)
+	}
+	scheme, rest, ok := strings.Cut(tmpl, "://")
+	if !ok || scheme == "" {
+		return Endpoint{}, fmt.Errorf("url template %q has no scheme", tmpl)
+	}
+	i := strings.IndexAny(rest, "/?")
+	if i <= 0 {
+		return Endpoint{}, fmt.Errorf("url template %q has no host or path", tmpl)
+	}
+	return Endpoint{BaseURL: scheme + "://" + rest[:i], Path: rest[i:]}, nil
+}
+
+// readUserIDs 读取以空白分隔的用户 ID，忽略空行、# 开头的注释与重复的 ID
+func readUserIDs(r io.Reader) ([]int, error) {
+	var ids []int
+	seen := map[int]bool{}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		for _, field := range strings.Fields(text) {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid user ID %q", line, field)
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, sc.Err()
+}
+
+// openResumable 打开输出文件用于追加，返回其中已经成功的用户。
+// 失败的记录被移除，续跑时重新请求；上次运行中断留下的不完整末行会被截掉。
+func openResumable(path string) (*os.File, map[int]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	seen := map[int]bool{}
+	var kept bytes.Buffer
+	var complete int
+	for line := range bytes.Lines(data) {
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			break
+		}
+		complete += len(line)
+
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(trimmed, &rec); err != nil {
+			return nil, nil, fmt.Errorf("%s: invalid record before byte %d: %w", path, complete, err)
+		}
+		if rec.Error != "" {
+			continue
+		}
+		seen[rec.UserId] = true
+		kept.Write(line)
+	}
+
+	if kept.Len() != len(data) {
+		// 先写临时文件再替换，重写时中断不会丢失已有的结果
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, kept.Bytes(), 0o644); err != nil {
+			return nil, nil, err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return nil, nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, seen, nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Coordinator 在本机通过 Unix domain socket 为多个进程发放 token，
+// 同一个 key 的所有进程共用一个 rate.Limiter。
+// 协议为每行一个 JSON：请求 coordinatorRequest，响应 coordinatorResponse。
+type Coordinator struct {
+	mu           sync.Mutex
+	limiters     map[string]*coordinatedLimiter
+	reservations map[reservationKey]*rate.Reservation
+	nextID       uint64
+	conns        map[net.Conn]struct{}
+	ln           net.Listener
+}
+
+// coordinatedLimiter 是一个 key 共用的 limiter 以及每个连接最近一次声明的速率
+type coordinatedLimiter struct {
+	lim   *rate.Limiter
+	rates map[net.Conn]rate.Limit
+}
+
+// reservationKey 标识一个连接取得的预约，连接只能归还自己的预约
+type reservationKey struct {
+	conn net.Conn
+	id   uint64
+}
+
+type coordinatorRequest struct {
+	Key   string     `json:"key"`
+	Rate  rate.Limit `json:"rate"`
+	Burst int        `json:"burst"`
+	// Wait 为 false 时只在有 token 时取走，为 true 时预约下一个 token
+	Wait bool `json:"wait"`
+	// Cancel 非零时归还本连接上该编号的预约，其它字段被忽略
+	Cancel uint64 `json:"cancel,omitempty"`
+}
+
+type coordinatorResponse struct {
+	Allowed bool          `json:"allowed"`
+	Delay   time.Duration `json:"delay"`
+	// ID 是需要等待的预约的编号，调用方放弃等待时用它归还 token
+	ID    uint64 `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func NewCoordinator() *Coordinator {
+	return &Coordinator{
+		limiters:     make(map[string]*coordinatedLimiter),
+		reservations: make(map[reservationKey]*rate.Reservation),
+		conns:        make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe 在 path 上监听并处理请求，path 上残留的 socket 文件会被删除
+func (c *Coordinator) ListenAndServe(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return c.Serve(ln)
+}
+
+// Serve 处理 ln 上的连接，直到 Close 被调用
+func (c *Coordinator) Serve(ln net.Listener) error {
+	c.mu.Lock()
+	c.ln = ln
+	c.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		c.mu.Lock()
+		c.conns[conn] = struct{}{}
+		c.mu.Unlock()
+		go c.serveConn(conn)
+	}
+}
+
+// Close 停止监听并断开所有连接
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	if c.ln == nil {
+		return nil
+	}
+	return c.ln.Close()
+}
+
+func (c *Coordinator) serveConn(conn net.Conn) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.conns, conn)
+		for _, l := range c.limiters {
+			if _, ok := l.rates[conn]; ok {
+				delete(l.rates, conn)
+				l.update()
+			}
+		}
+		// 只丢弃预约而不归还 token：客户端可能只是连接出错，仍会在等待结束后使用它
+		for k := range c.reservations {
+			if k.conn == conn {
+				delete(c.reservations, k)
+			}
+		}
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		var req coordinatorRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		if err := enc.Encode(c.take(conn, req)); err != nil {
+			return
+		}
+	}
+}
+
+// take 从 key 对应的 limiter 取 token，从不阻塞。速率取各连接最近一次声明的最小值，
+// 这样任何一个进程的 adaptive 降速都会生效，而不会被其它进程的请求覆盖；
+// 连接断开后它声明的速率不再计入。
+func (c *Coordinator) take(conn net.Conn, req coordinatorRequest) coordinatorResponse {
+	if req.Cancel != 0 {
+		c.cancel(reservationKey{conn: conn, id: req.Cancel})
+		return coordinatorResponse{}
+	}
+
+	c.mu.Lock()
+	l, ok := c.limiters[req.Key]
+	if !ok {
+		l = &coordinatedLimiter{lim: rate.NewLimiter(req.Rate, req.Burst), rates: make(map[net.Conn]rate.Limit)}
+		c.limiters[req.Key] = l
+	}
+	if prev, ok := l.rates[conn]; !ok || prev != req.Rate {
+		l.rates[conn] = req.Rate
+		l.update()
+	}
+	c.mu.Unlock()
+
+	if !req.Wait {
+		return coordinatorResponse{Allowed: l.lim.Allow()}
+	}
+	r := l.lim.Reserve()
+	if !r.OK() {
+		return coordinatorResponse{Error: "rate: burst is zero, no token will ever be available"}
+	}
+	resp := coordinatorResponse{Allowed: true, Delay: r.Delay()}
+	if resp.Delay > 0 {
+		// 记录需要等待的预约，等待结束后不能再归还
+		c.mu.Lock()
+		c.nextID++
+		resp.ID = c.nextID
+		key := reservationKey{conn: conn, id: resp.ID}
+		c.reservations[key] = r
+		c.mu.Unlock()
+		time.AfterFunc(resp.Delay, func() {
+			c.mu.Lock()
+			delete(c.reservations, key)
+			c.mu.Unlock()
+		})
+	}
+	return resp
+}
+
+// cancel 归还 key 对应的预约，让其它等待者更早拿到 token
+func (c *Coordinator) cancel(key reservationKey) {
+	c.mu.Lock()
+	r, ok := c.reservations[key]
+	delete(c.reservations, key)
+	c.mu.Unlock()
+	if ok {
+		r.Cancel()
+	}
+}
+
+// update 把 limiter 的速率设为各连接声明的最小值，调用方需持有 Coordinator.mu
+func (l *coordinatedLimiter) update() {
+	if len(l.rates) == 0 {
+		return
+	}
+	limit := rate.Inf
+	for _, r := range l.rates {
+		limit = min(limit, r)
+	}
+	if l.lim.Limit() != limit {
+		l.lim.SetLimit(limit)
+	}
+}
+
+const (
+	DefaultCoordinatorTimeout = time.Second
+	DefaultFallbackFraction   = 0.25
+)
+
+// CoordinatorBackend 通过 Coordinator 与本机其它进程共享配额。Coordinator 不可达时，
+// 每个 limiter 退回到本地速率 Rate*FallbackFraction、burst 为 1 的保守限流，
+// 并在 RetryInterval 后重新连接。零值字段使用默认值。
+type CoordinatorBackend struct {
+	Socket           string
+	Timeout          time.Duration
+	RetryInterval    time.Duration
+	FallbackFraction float64
+
+	// io 让连接上的请求串行执行；mu 只保护连接状态，往返期间不持有，
+	// 这样 Coordinator 不可达时其它调用方可以直接退回本地 limiter，Close 也可以打断往返
+	io        sync.Mutex
+	mu        sync.Mutex
+	conn      *coordinatorConn
+	downUntil time.Time
+}
+
+// coordinatorConn 是与 Coordinator 的一个连接，预约只能通过取得它的连接归还
+type coordinatorConn struct {
+	net.Conn
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+// NewCoordinatorBackend 返回连接到 socket 的后端，连接在第一次取 token 时建立
+func NewCoordinatorBackend(socket string) *CoordinatorBackend {
+	return &CoordinatorBackend{Socket: socket}
+}
+
+func (b *CoordinatorBackend) NewLimiter(key string, r rate.Limit, burst int) Limiter {
+	l := &sharedLimiter{backend: b, key: key, limit: r, burst: burst}
+	l.fallback = rate.NewLimiter(l.fallbackLimit(r), 1)
+	return l
+}
+
+// Close 断开与 Coordinator 的连接
+func (b *CoordinatorBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+// take 向 Coordinator 发送一次请求，所有 limiter 共用一个连接，请求串行执行。
+// 返回的 error 只表示 Coordinator 不可达，Coordinator 拒绝的请求见 resp.Error；
+// 返回的连接用于归还这次请求取得的预约。
+func (b *CoordinatorBackend) take(req coordinatorRequest) (coordinatorResponse, *coordinatorConn, error) {
+	// 不可达期间不必排在其它往返之后
+	if _, err := b.current(); err != nil {
+		return coordinatorResponse{}, nil, err
+	}
+
+	b.io.Lock()
+	defer b.io.Unlock()
+	cc, err := b.current()
+	if err != nil {
+		return coordinatorResponse{}, nil, err
+	}
+	if cc == nil {
+		if cc, err = b.dial(); err != nil {
+			return coordinatorResponse{}, nil, err
+		}
+	}
+	resp, err := b.roundTrip(cc, req)
+	return resp, cc, err
+}
+
+// cancel 通过 cc 归还编号为 id 的预约。cc 已经断开时 Coordinator 已丢弃了它的预约，不再发送。
+func (b *CoordinatorBackend) cancel(cc *coordinatorConn, key string, id uint64) {
+	b.io.Lock()
+	defer b.io.Unlock()
+	if cur, _ := b.current(); cur == cc {
+		b.roundTrip(cc, coordinatorRequest{Key: key, Cancel: id})
+	}
+}
+
+// current 返回当前的连接，尚未连接时返回 nil，处于 RetryInterval 内时返回 errCoordinatorDown
+func (b *CoordinatorBackend) current() (*coordinatorConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil && time.Now().Before(b.downUntil) {
+		return nil, errCoordinatorDown
+	}
+	return b.conn, nil
+}
+
+// dial 建立新连接，调用方需持有 b.io
+func (b *CoordinatorBackend) dial() (*coordinatorConn, error) {
+	conn, err := net.DialTimeout("unix", b.Socket, b.timeout())
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.markDown(err)
+		return nil, err
+	}
+	b.conn = &coordinatorConn{
+		Conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(bufio.NewReader(conn)),
+	}
+	return b.conn, nil
+}
+
+// roundTrip 在 cc 上发送 req 并读取响应，出错时断开 cc，调用方需持有 b.io
+func (b *CoordinatorBackend) roundTrip(cc *coordinatorConn, req coordinatorRequest) (coordinatorResponse, error) {
+	var resp coordinatorResponse
+	cc.SetDeadline(time.Now().Add(b.timeout()))
+	err := cc.enc.Encode(req)
+	if err == nil {
+		err = cc.dec.Decode(&resp)
+	}
+	if err != nil {
+		cc.Close()
+		b.mu.Lock()
+		// Close 已经断开的连接不算 Coordinator 不可达
+		if b.conn == cc {
+			b.conn = nil
+			b.markDown(err)
+		}
+		b.mu.Unlock()
+		return coordinatorResponse{}, err
+	}
+	return resp, nil
+}
+
+var errCoordinatorDown = errors.New("coordinator unreachable")
+
+// markDown 在 RetryInterval 内不再尝试连接，调用方需持有 b.mu
+func (b *CoordinatorBackend) markDown(err error) {
+	if time.Now().After(b.downUntil) {
+		slog.Warn("rate limit coordinator unreachable, using local fallback",
+			slog.String("socket", b.Socket),
+			slog.Any("err", err))
+	}
+	b.downUntil = time.Now().Add(b.retryInterval())
+}
+
+func (b *CoordinatorBackend) timeout() time.Duration {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return DefaultCoordinatorTimeout
+}
+
+func (b *CoordinatorBackend) retryInterval() time.Duration {
+	if b.RetryInterval > 0 {
+		return b.RetryInterval
+	}
+	return 5 * b.timeout()
+}
+
+// sharedLimiter 优先从 Coordinator 取 token，不可达时使用本地的保守 limiter
+type sharedLimiter struct {
+	backend  *CoordinatorBackend
+	key      string
+	burst    int
+	fallback *rate.Limiter
+
+	mu    sync.Mutex
+	limit rate.Limit
+}
+
+func (l *sharedLimiter) fallbackLimit(r rate.Limit) rate.Limit {
+	fraction := l.backend.FallbackFraction
+	if fraction <= 0 || fraction > 1 {
+		fraction = DefaultFallbackFraction
+	}
+	return r * rate.Limit(fraction)
+}
+
+func (l *sharedLimiter) request(wait bool) coordinatorRequest {
+	return coordinatorRequest{Key: l.key, Rate: l.Limit(), Burst: l.burst, Wait: wait}
+}
+
+func (l *sharedLimiter) Allow() bool {
+	resp, _, err := l.backend.take(l.request(false))
+	if err != nil {
+		return l.fallback.Allow()
+	}
+	return resp.Allowed
+}
+
+func (l *sharedLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	resp, cc, err := l.backend.take(l.request(true))
+	if err != nil {
+		return l.fallback.Wait(ctx)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if err := sleep(ctx, resp.Delay); err != nil {
+		if resp.ID != 0 {
+			// 放弃等待时归还预约的 token，其它进程可以更早使用
+			l.backend.cancel(cc, l.key, resp.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *sharedLimiter) Limit() rate.Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// SetLimit 在下一次请求时同步给 Coordinator
+func (l *sharedLimiter) SetLimit(r rate.Limit) {
+	l.mu.Lock()
+	l.limit = r
+	l.mu.Unlock()
+	l.fallback.SetLimit(l.fallbackLimit(r))
+}
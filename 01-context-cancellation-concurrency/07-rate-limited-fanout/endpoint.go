@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultBaseURL = "https://api.sampleapis.com"
+	DefaultPath    = "/avatar/info"
+)
+
+// AuthFunc 在请求发出前添加认证信息
+type AuthFunc func(req *http.Request) error
+
+// BearerAuth 添加 Authorization: Bearer token
+func BearerAuth(token string) AuthFunc {
+	return func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+}
+
+// HeaderAuth 把 API key 放在指定的请求头中
+func HeaderAuth(name, value string) AuthFunc {
+	return func(req *http.Request) error {
+		req.Header.Set(name, value)
+		return nil
+	}
+}
+
+// Endpoint 描述如何为一个用户构造请求。Path 中的 {userId} 会被替换为转义后的用户 ID，
+// Path 可以带查询参数，例如 "/users/{userId}/avatar" 或 "/avatar?id={userId}"。
+type Endpoint struct {
+	BaseURL string
+	Path    string
+	Header  http.Header
+	Auth    AuthFunc
+}
+
+// WithEndpoint 设置请求的基础地址、路径模板、公共请求头与认证方式
+func WithEndpoint(e Endpoint) Option {
+	return func(f *FanOutClient) {
+		f.endpoint = e
+	}
+}
+
+type requestHeaderCtx struct{}
+
+// WithRequestHeader 为 ctx 上的请求额外添加请求头，可多次调用叠加
+func WithRequestHeader(ctx context.Context, key, value string) context.Context {
+	h := http.Header{}
+	if prev, ok := ctx.Value(requestHeaderCtx{}).(http.Header); ok {
+		h = prev.Clone()
+	}
+	h.Add(key, value)
+	return context.WithValue(ctx, requestHeaderCtx{}, h)
+}
+
+// url 返回 userId 对应的完整地址
+func (e *Endpoint) url(userId int) string {
+	path := strings.ReplaceAll(e.Path, "{userId}", url.PathEscape(strconv.Itoa(userId)))
+	return strings.TrimRight(e.BaseURL, "/") + path
+}
+
+// newRequest 构造 userId 的请求
+func (e *Endpoint) newRequest(ctx context.Context, userId int) (*http.Request, error) {
+	return e.request(ctx, e.url(userId))
+}
+
+// request 构造 rawURL 的请求，依次添加公共请求头、ctx 上的请求头与认证信息
+func (e *Endpoint) request(ctx context.Context, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if h, ok := ctx.Value(requestHeaderCtx{}).(http.Header); ok {
+		for k, vs := range h {
+			for _, v := range vs {
+				req.Header.Add(k, v)
+			}
+		}
+	}
+	if e.Auth != nil {
+		if err := e.Auth(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter 为一个桶发放 token，*rate.Limiter 满足这个接口
+type Limiter interface {
+	// Allow 在有 token 时取走一个并返回 true，不会阻塞
+	Allow() bool
+	// Wait 阻塞到取得一个 token 或 ctx 结束
+	Wait(ctx context.Context) error
+	Limit() rate.Limit
+	SetLimit(r rate.Limit)
+}
+
+// LimiterBackend 为每个桶创建 Limiter
+type LimiterBackend interface {
+	NewLimiter(key string, r rate.Limit, burst int) Limiter
+}
+
+// LocalBackend 在进程内限流，是默认的后端
+type LocalBackend struct{}
+
+func (LocalBackend) NewLimiter(_ string, r rate.Limit, burst int) Limiter {
+	return rate.NewLimiter(r, burst)
+}
+
+// WithLimiterBackend 设置创建桶的 limiter 所用的后端，例如多个进程共享配额的 CoordinatorBackend
+func WithLimiterBackend(b LimiterBackend) Option {
+	return func(f *FanOutClient) {
+		f.buckets.backend = b
+	}
+}
@@ -1,28 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
+	"flag"
 	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/sync/semaphore"
-	"golang.org/x/time/rate"
 )
 
+type Option func(*FanOutClient)
+
+// maxDrainBytes 是错误响应最多读掉的字节数，更大的响应直接关闭连接
+const maxDrainBytes = 64 << 10
+
+// FanOutClient 按主机（或调用方指定的键）分桶限流，每个桶有独立的 limiter 与并发上限
 type FanOutClient struct {
-	client  *http.Client
-	limiter *rate.Limiter
-	sem     *semaphore.Weighted
+	client      *http.Client
+	endpoint    Endpoint
+	buckets     *bucketPool
+	batch       *Batch
+	cache       *responseCache
+	retry       *retrier
+	maxInFlight int64
 }
 
-func NewFanOutClient(limit float64, burst int, maxInFlight int64) *FanOutClient {
-	return &FanOutClient{
+func NewFanOutClient(limit float64, burst int, maxInFlight int64, opts ...Option) *FanOutClient {
+	f := &FanOutClient{
 		client: &http.Client{
 			Transport: &http.Transport{
 				MaxIdleConns:        100,
@@ -31,47 +42,105 @@ func NewFanOutClient(limit float64, burst int, maxInFlight int64) *FanOutClient
 			},
 			Timeout: 10 * time.Second,
 		},
-		limiter: rate.NewLimiter(rate.Limit(limit), burst),
-		sem:     semaphore.NewWeighted(maxInFlight),
+		endpoint:    Endpoint{BaseURL: DefaultBaseURL, Path: DefaultPath},
+		buckets:     newBucketPool(HostLimits{Rate: limit, Burst: burst, MaxInFlight: maxInFlight}),
+		maxInFlight: maxInFlight,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// WithHTTPClient 替换默认的 http.Client，所有请求共用它的连接池
+func WithHTTPClient(client *http.Client) Option {
+	return func(f *FanOutClient) {
+		f.client = client
 	}
 }
 
 func (f *FanOutClient) FetchOne(ctx context.Context, userId int) ([]byte, error) {
-	// 并发限制
-	if err := f.sem.Acquire(ctx, 1); err != nil {
+	req, err := f.endpoint.newRequest(ctx, userId)
+	if err != nil {
 		return nil, err
 	}
-	defer f.sem.Release(1)
+	return f.do(ctx, req)
+}
 
-	// 速率限制
-	if err := f.limiter.Wait(ctx); err != nil {
-		return nil, err
+// do 发送 req，配置了重试时在两次尝试之间退避，退避期间不占用并发槽位
+func (f *FanOutClient) do(ctx context.Context, req *http.Request) ([]byte, error) {
+	// 新鲜的缓存不占用并发槽位与 token
+	cached, fresh := f.cache.lookup(req)
+	if fresh {
+		return bytes.Clone(cached.body), nil
 	}
 
-	if userId > 99999 {
-		return nil, fmt.Errorf("fail fast")
+	b := f.buckets.acquire(bucketKey(ctx, req.URL))
+	defer f.buckets.release(b)
+
+	f.retry.deposit()
+	for attempt := 1; ; attempt++ {
+		body, err := f.send(ctx, b, req, cached)
+		delay, ok := f.retry.next(ctx, attempt, err)
+		if !ok {
+			return body, err
+		}
+
+		slog.Info("retrying request",
+			slog.String("url", req.URL.String()),
+			slog.Int("attempt", attempt),
+			slog.Duration("delay", delay),
+			slog.Any("err", err))
+
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	url := "https://api.sampleapis.com/avatar/info"
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
+// send 在桶中按优先级占用一个并发槽位与一个 limiter token 后发送一次请求
+func (f *FanOutClient) send(ctx context.Context, b *bucket, req *http.Request, cached *cacheEntry) ([]byte, error) {
+	// 上游要求暂停时先等到暂停结束
+	if err := b.adaptive.wait(ctx); err != nil {
+		return nil, err
+	}
+	// 并发限制与速率限制
+	if err := b.gate.acquire(ctx, priorityOf(ctx)); err != nil {
 		return nil, err
 	}
-	cli := http.Client{}
-	resp, err := cli.Do(req)
+	defer b.sem.Release(1)
+
+	// 所有请求都经过同一个 client，复用它的连接池
+	sent := time.Now()
+	resp, err := f.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	wait := b.adaptive.observe(resp, sent)
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		f.cache.revalidated(cached, resp.Header)
+		return bytes.Clone(cached.body), nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("api error: %d", resp.StatusCode)
+		// 读掉少量剩余内容，连接才能放回连接池
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+		return nil, &StatusError{StatusCode: resp.StatusCode, RetryAfter: wait}
 	}
 
-	return io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.store(req, resp.Header, body)
+	return body, nil
 }
 
 func (f *FanOutClient) FetchAll(ctx context.Context, userIDs []int) (map[int][]byte, error) {
+	if f.batch != nil {
+		return f.fetchAllBatched(ctx, userIDs)
+	}
 
 	g, ctx := errgroup.WithContext(ctx)
 	results := make(map[int][]byte)
@@ -109,12 +178,14 @@ func (f *FanOutClient) FetchAll(ctx context.Context, userIDs []int) (map[int][]b
 }
 
 func main() {
-	client := NewFanOutClient(10, 8, 20)
-	resp, err := client.FetchAll(context.Background(), []int{1, 2, 3, 4, 5})
-	if err != nil {
-		slog.Error("client fetch all", slog.Any("err", err))
-		return
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := runCLI(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			slog.Error("fanout failed", slog.Any("err", err))
+		}
+		stop()
+		os.Exit(1)
 	}
-	data, _ := json.Marshal(resp)
-	slog.Info("client fetch all", slog.String("resp", string(data)))
 }
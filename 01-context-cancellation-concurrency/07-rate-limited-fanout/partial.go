@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrTooManyFailures 表示失败比例超过阈值，剩余的请求已被取消
+var ErrTooManyFailures = errors.New("failure ratio exceeded")
+
+// UserError 记录某个用户的请求失败原因
+type UserError struct {
+	UserId int
+	Err    error
+}
+
+func (e *UserError) Error() string {
+	return fmt.Sprintf("user %d: %v", e.UserId, e.Err)
+}
+
+func (e *UserError) Unwrap() error {
+	return e.Err
+}
+
+// PartialResult 同时保存成功的结果与每个失败用户的错误
+type PartialResult struct {
+	Results map[int][]byte
+	Errors  map[int]error
+}
+
+// Err 把所有失败按 userId 排序后合并为一个错误，没有失败时返回 nil
+func (r *PartialResult) Err() error {
+	ids := make([]int, 0, len(r.Errors))
+	for id := range r.Errors {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	errs := make([]error, 0, len(ids))
+	for _, id := range ids {
+		errs = append(errs, &UserError{UserId: id, Err: r.Errors[id]})
+	}
+	return errors.Join(errs...)
+}
+
+type PartialOption func(*partialConfig)
+
+type partialConfig struct {
+	maxFailureRatio float64
+}
+
+// WithMaxFailureRatio 失败数超过 ratio*len(userIDs) 时取消剩余的请求，
+// 未完成的用户记为 ErrTooManyFailures
+func WithMaxFailureRatio(ratio float64) PartialOption {
+	return func(c *partialConfig) {
+		c.maxFailureRatio = ratio
+	}
+}
+
+// FetchAllPartial 与 FetchAll 一样受限流器与并发上限约束，但单个用户失败不会取消其余请求。
+// 返回的 error 只在失败比例超过阈值或 ctx 被取消时非 nil，各用户的错误见 PartialResult.Errors。
+func (f *FanOutClient) FetchAllPartial(ctx context.Context, userIDs []int, opts ...PartialOption) (*PartialResult, error) {
+	cfg := partialConfig{maxFailureRatio: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	res := &PartialResult{
+		Results: make(map[int][]byte),
+		Errors:  make(map[int]error),
+	}
+	maxFailures := int(cfg.maxFailureRatio * float64(len(userIDs)))
+	failures := 0
+	mu := &sync.Mutex{}
+
+	// 最多同时有 maxInFlight 个 goroutine，其余用户在这里排队而不是各占一个 goroutine
+	var g errgroup.Group
+	g.SetLimit(int(max(f.maxInFlight, 1)))
+	for _, userId := range userIDs {
+		g.Go(func() error {
+			start := time.Now()
+			data, err := f.FetchOne(ctx, userId)
+
+			slog.Info("request completed",
+				slog.Int("userID", userId),
+				slog.Duration("latency", time.Since(start)),
+				slog.Bool("success", err == nil))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				res.Results[userId] = data
+				return nil
+			}
+			if cause := context.Cause(ctx); cause != nil {
+				// 已经取消时失败的请求不计入失败数，记录取消的原因
+				err = cause
+			} else if failures++; failures > maxFailures {
+				cancel(fmt.Errorf("%w: %d of %d requests failed", ErrTooManyFailures, failures, len(userIDs)))
+			}
+			res.Errors[userId] = err
+			return nil
+		})
+	}
+	g.Wait()
+
+	return res, context.Cause(ctx)
+}
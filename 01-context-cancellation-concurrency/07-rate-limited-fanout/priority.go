@@ -0,0 +1,248 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Priority 是请求的优先级，数值越大越先获得并发槽位与 limiter token
+type Priority int
+
+const (
+	PriorityBackground Priority = iota
+	PriorityNormal
+	PriorityInteractive
+)
+
+// DefaultPriorityAging 是等待中的请求提升一个优先级所需的时间
+const DefaultPriorityAging = time.Second
+
+type priorityCtx struct{}
+
+// WithPriority 设置 ctx 上请求的优先级，未设置时为 PriorityNormal
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityCtx{}, p)
+}
+
+func priorityOf(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityCtx{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// WithPriorityAging 设置老化速度：请求每等待 d 提升一个优先级，低优先级请求不会一直饿死。
+// d <= 0 时关闭老化，严格按优先级调度，同一优先级按到达顺序。
+func WithPriorityAging(d time.Duration) Option {
+	return func(f *FanOutClient) {
+		f.buckets.aging = d
+	}
+}
+
+// QueueStats 是某个优先级的请求等待并发槽位与 limiter token 的时间统计
+type QueueStats struct {
+	Count int
+	Total time.Duration
+	Max   time.Duration
+}
+
+// Mean 返回平均等待时间
+func (s QueueStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// QueueWait 返回各优先级至今的排队等待时间统计
+func (f *FanOutClient) QueueWait() map[Priority]QueueStats {
+	return f.buckets.waits.snapshot()
+}
+
+type queueStats struct {
+	mu    sync.Mutex
+	stats map[Priority]QueueStats
+}
+
+func (q *queueStats) record(p Priority, d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.stats[p]
+	s.Count++
+	s.Total += d
+	s.Max = max(s.Max, d)
+	q.stats[p] = s
+}
+
+func (q *queueStats) snapshot() map[Priority]QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make(map[Priority]QueueStats, len(q.stats))
+	for p, s := range q.stats {
+		out[p] = s
+	}
+	return out
+}
+
+// waiter 是排队中的请求。优先级 p 的请求等待 t 后的有效优先级为 p + t/aging，
+// 比较有效优先级等价于比较 enqueued - p*aging，因此堆的键不随时间变化。
+// 关闭老化时所有请求的键相同，按 prio 再按 seq 排序。
+type waiter struct {
+	prio     Priority
+	enqueued time.Time
+	key      time.Time
+	seq      uint64
+	index    int
+	ready    chan error
+}
+
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if !h[i].key.Equal(h[j].key) {
+		return h[i].key.Before(h[j].key)
+	}
+	if h[i].prio != h[j].prio {
+		return h[i].prio > h[j].prio
+	}
+	return h[i].seq < h[j].seq
+}
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *waiterHeap) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
+
+// priorityGate 按有效优先级依次为排队的请求取得一个并发槽位与一个 limiter token。
+// 队列为空时请求直接尝试获取；否则由一个 dispatcher goroutine 逐个获取后交给队首的请求，
+// 这样高优先级请求既先拿到槽位，也先拿到 token。
+type priorityGate struct {
+	sem     *semaphore.Weighted
+	limiter Limiter
+	aging   time.Duration
+	waits   *queueStats
+
+	mu      sync.Mutex
+	waiters waiterHeap
+	seq     uint64
+	stop    context.CancelFunc // 非 nil 表示 dispatcher 正在运行
+}
+
+// acquire 按优先级获取一个并发槽位与一个 limiter token，成功后调用方需 sem.Release(1)
+func (g *priorityGate) acquire(ctx context.Context, p Priority) error {
+	start := time.Now()
+	g.mu.Lock()
+	fast := len(g.waiters) == 0 && g.sem.TryAcquire(1)
+	g.mu.Unlock()
+	if fast {
+		// Allow 可能要与 Coordinator 通信，不能持有 g.mu
+		if g.limiter.Allow() {
+			g.waits.record(p, 0)
+			return nil
+		}
+		g.sem.Release(1)
+	}
+
+	g.mu.Lock()
+	g.seq++
+	w := &waiter{prio: p, enqueued: start, seq: g.seq, ready: make(chan error, 1)}
+	if g.aging > 0 {
+		w.key = start.Add(-time.Duration(p) * g.aging)
+	}
+	heap.Push(&g.waiters, w)
+	if g.stop == nil {
+		dctx, stop := context.WithCancel(context.Background())
+		g.stop = stop
+		go g.dispatch(dctx)
+	}
+	g.mu.Unlock()
+
+	select {
+	case err := <-w.ready:
+		return err
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if w.index >= 0 {
+		heap.Remove(&g.waiters, w.index)
+		if len(g.waiters) == 0 && g.stop != nil {
+			g.stop()
+			g.stop = nil
+		}
+	} else if err := <-w.ready; err == nil {
+		// 取消与分配同时发生，归还已经分配的槽位
+		g.sem.Release(1)
+	}
+	return ctx.Err()
+}
+
+// dispatch 在队列非空时循环：先取得槽位与 token，再交给此刻有效优先级最高的请求
+func (g *priorityGate) dispatch(ctx context.Context) {
+	for {
+		g.mu.Lock()
+		if ctx.Err() != nil {
+			g.mu.Unlock()
+			return
+		}
+		if len(g.waiters) == 0 {
+			g.stop()
+			g.stop = nil
+			g.mu.Unlock()
+			return
+		}
+		g.mu.Unlock()
+
+		if err := g.sem.Acquire(ctx, 1); err != nil {
+			return
+		}
+		if err := g.limiter.Wait(ctx); err != nil {
+			g.sem.Release(1)
+			if ctx.Err() != nil {
+				return
+			}
+			// 例如 burst 为 0，永远不会有 token
+			g.fail(err)
+			continue
+		}
+
+		g.mu.Lock()
+		if ctx.Err() != nil || len(g.waiters) == 0 {
+			g.mu.Unlock()
+			g.sem.Release(1)
+			continue
+		}
+		w := heap.Pop(&g.waiters).(*waiter)
+		w.ready <- nil
+		g.mu.Unlock()
+		g.waits.record(w.prio, time.Since(w.enqueued))
+	}
+}
+
+// fail 让所有排队的请求返回 err
+func (g *priorityGate) fail(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for len(g.waiters) > 0 {
+		heap.Pop(&g.waiters).(*waiter).ready <- err
+	}
+}
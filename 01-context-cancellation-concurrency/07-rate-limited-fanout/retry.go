@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryPolicy 配置超时与 502/503/504 的重试。每次重试都会重新占用并发槽位与 limiter token。
+// 为了防止重试风暴，所有请求共用一个重试预算：初始有 MinRetries 次（负数表示没有），
+// 之后每个请求存入 MaxRetryRatio 次，预算不足时直接返回错误。
+// 每次重试最多等待 MaxDelay，上游的 Retry-After 更长时直接返回错误。零值字段使用默认值。
+type RetryPolicy struct {
+	MaxAttempts   int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	MaxRetryRatio float64
+	MinRetries    int
+}
+
+// WithRetry 为所有请求启用带指数退避与抖动的重试
+func WithRetry(p RetryPolicy) Option {
+	return func(f *FanOutClient) {
+		if p.MaxAttempts <= 0 {
+			p.MaxAttempts = 3
+		}
+		if p.BaseDelay <= 0 {
+			p.BaseDelay = 100 * time.Millisecond
+		}
+		if p.MaxDelay <= 0 {
+			p.MaxDelay = 5 * time.Second
+		}
+		if p.MaxRetryRatio <= 0 {
+			p.MaxRetryRatio = 0.1
+		}
+		if p.MinRetries < 0 {
+			p.MinRetries = 0
+		} else if p.MinRetries == 0 {
+			p.MinRetries = 10
+		}
+		f.retry = &retrier{policy: p, budget: float64(p.MinRetries)}
+	}
+}
+
+type retrier struct {
+	policy RetryPolicy
+
+	mu     sync.Mutex
+	budget float64
+}
+
+// deposit 在每个请求开始时存入重试预算，预算最多累积 max(MinRetries, 1) 次
+func (r *retrier) deposit() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.budget = min(r.budget+r.policy.MaxRetryRatio, float64(max(r.policy.MinRetries, 1)))
+}
+
+// next 判断第 attempt 次尝试失败后是否重试，返回重试前的等待时间
+func (r *retrier) next(ctx context.Context, attempt int, err error) (time.Duration, bool) {
+	if r == nil || err == nil || attempt >= r.policy.MaxAttempts || ctx.Err() != nil || !retryable(err) {
+		return 0, false
+	}
+
+	// 上游要求等待的时间超过 MaxDelay 时不重试，也不消耗预算
+	var (
+		retryAfter time.Duration
+		statusErr  *StatusError
+	)
+	if errors.As(err, &statusErr) {
+		retryAfter = statusErr.RetryAfter
+	}
+	if retryAfter > r.policy.MaxDelay {
+		return 0, false
+	}
+
+	r.mu.Lock()
+	if r.budget < 1 {
+		r.mu.Unlock()
+		return 0, false
+	}
+	r.budget--
+	r.mu.Unlock()
+
+	// 全抖动：在 [0, min(MaxDelay, BaseDelay*2^(attempt-1))) 中随机选择
+	backoff := r.policy.BaseDelay
+	for i := 1; i < attempt && backoff < r.policy.MaxDelay; i++ {
+		backoff *= 2
+	}
+	return max(rand.N(min(backoff, r.policy.MaxDelay)), retryAfter), true
+}
+
+// retryable 判断错误是否是值得重试的瞬时错误
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// sleep 等待 d，ctx 取消时立即返回
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
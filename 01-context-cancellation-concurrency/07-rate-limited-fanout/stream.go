@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"iter"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// StreamResult 是流式接口中一个用户的请求结果
+type StreamResult struct {
+	Data    []byte
+	Err     error
+	Latency time.Duration
+}
+
+type streamItem struct {
+	userId int
+	res    StreamResult
+}
+
+// FetchStream 按完成顺序逐个产出每个用户的结果，不在内存中保留全部响应。
+// 最多 maxInFlight 个 worker 同时工作，调用方消费变慢时 worker 阻塞在交付结果上，
+// 不会再发起新的请求。调用方提前 break 或 ctx 被取消时，返回前会等待所有 goroutine
+// 退出并释放并发槽位；ctx 被取消后尚未交付的用户不会再产出，调用方需检查 ctx.Err()。
+func (f *FanOutClient) FetchStream(ctx context.Context, userIDs []int) iter.Seq2[int, StreamResult] {
+	return func(yield func(int, StreamResult) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		defer cancel()
+
+		ids := make(chan int)
+		results := make(chan streamItem)
+
+		wg.Go(func() {
+			defer close(ids)
+			for _, userId := range userIDs {
+				select {
+				case ids <- userId:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+
+		var workers sync.WaitGroup
+		for range min(int(max(f.maxInFlight, 1)), len(userIDs)) {
+			workers.Go(func() {
+				for userId := range ids {
+					start := time.Now()
+					data, err := f.FetchOne(ctx, userId)
+					latency := time.Since(start)
+
+					slog.Info("request completed",
+						slog.Int("userID", userId),
+						slog.Duration("latency", latency),
+						slog.Bool("success", err == nil))
+
+					// 结果交付之前不会领取下一个用户，形成背压
+					select {
+					case results <- streamItem{userId, StreamResult{Data: data, Err: err, Latency: latency}}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			})
+		}
+		wg.Go(func() {
+			workers.Wait()
+			close(results)
+		})
+
+		for item := range results {
+			if !yield(item.userId, item.res) {
+				return
+			}
+		}
+	}
+}